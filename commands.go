@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+	"vmc-dns-sync/pkg/dns_api"
+	"vmc-dns-sync/pkg/model"
+	"vmc-dns-sync/pkg/triage"
+)
+
+// newOneShotWatchers - one-shot commands never use the watch caches, only a
+// vCenter session to log out of when done
+func newOneShotWatchers() watchers {
+	return watchers{vcenter: dns_api.NewVCenterSession()}
+}
+
+func runPlan(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	output := flags.String("o", "table", "output format: table or json")
+	out := flags.String("out", "", "save the plan to this file for a later 'apply -plan'")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vmc-dns-sync plan [-o table|json] [-out file]\n\n"+
+			"Prints the adds, updates and deletes a sync would send to the DNS provider. Nothing is changed.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown output format %q\n", *output)
+		return 2
+	}
+
+	provider, err := dns_api.GetDNSProvider(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Plan failed: %v\n", err)
+		return 1
+	}
+
+	logger := newCycleLogger().With("type", "plan")
+	w := newOneShotWatchers()
+	defer w.vcenter.Logout(logger)
+	result, _, err := buildTriage(ctx, logger, w, provider)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Plan failed: %v\n", err)
+		return 1
+	}
+
+	plan := triage.BuildPlan(result, provider.Zone(), time.Now())
+
+	if *output == "json" {
+		err = plan.WriteJSON(os.Stdout)
+	} else {
+		err = plan.WriteTable(os.Stdout)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Plan could not be printed: %v\n", err)
+		return 1
+	}
+
+	if *out != "" {
+		var content bytes.Buffer
+		if err = plan.WriteJSON(&content); err == nil {
+			err = ioutil.WriteFile(*out, content.Bytes(), 0644)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Plan could not be saved: %v\n", err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Plan saved to %s. Apply it with: vmc-dns-sync apply -plan %s\n", *out, *out)
+	}
+
+	if err = triage.CheckDeleteGuard(logger, result); err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: apply would be refused - %v\n", err)
+	}
+
+	return 0
+}
+
+func runApply(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	planPath := flags.String("plan", "", "apply a plan saved by 'plan -out' instead of the current triage")
+	maxAge := flags.Duration("max-age", 15*time.Minute, "refuse saved plans older than this")
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vmc-dns-sync apply [-plan file] [-max-age duration]\n\n"+
+			"Runs one sync against the DNS provider, regardless of R53_UPDATE_DRY_RUN. With -plan, only the reviewed\n"+
+			"changes are sent, and only if the hosts still have the IPs the plan saw.")
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	provider, err := dns_api.GetDNSProvider(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Apply failed: %v\n", err)
+		return 1
+	}
+
+	logger := newCycleLogger().With("type", "apply")
+	w := newOneShotWatchers()
+	defer w.vcenter.Logout(logger)
+	result, input, err := buildTriage(ctx, logger, w, provider)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Apply failed: %v\n", err)
+		return 1
+	}
+
+	if *planPath != "" {
+		plan, err := triage.LoadPlan(*planPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Plan could not be read: %v\n", err)
+			return 1
+		}
+
+		err = triage.CheckPlanFresh(plan, result, provider.Zone(), *maxAge, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Refusing to apply %s: %v. Run plan again\n", *planPath, err)
+			return 1
+		}
+
+		logger.Info("Applying reviewed changes", "changes", len(plan.Changes), "plan", *planPath)
+		result = plan.Restrict(result)
+	}
+
+	report, err := triage.ApplyDNS(ctx, logger, result, provider)
+	updateStatus(logger, input, result, report)
+
+	// a batch that failed still leaves the others applied, so report those
+	var batchErr *model.BatchError
+	if err != nil && !errors.As(err, &batchErr) {
+		fmt.Fprintf(os.Stderr, "Apply failed: %v\n", err)
+		return 1
+	}
+
+	fmt.Printf("Apply complete: %d added, %d updated, %d deleted.\n",
+		report.Applied("add"), report.Applied("update"), report.Applied("delete"))
+	for _, skipped := range report.Skipped {
+		fmt.Printf("Skipped %s: %s\n", skipped.Hostname, skipped.Reason)
+	}
+
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Apply failed: %v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+	"vmc-dns-sync/pkg/dns_api"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/metrics"
+	"vmc-dns-sync/pkg/model"
+)
+
+func waitForNextSync(ctx context.Context, w watchers, nextFullSync time.Time) *syncScope {
+	// block until the next full sync is due or until a watch reports
+	// a change. Returns the scope of the change, nil for a full sync
+	timer := time.NewTimer(time.Until(nextFullSync))
+	defer timer.Stop()
+
+	// a nil channel blocks forever, which keeps disabled watches out of the select
+	var vmChanged, configmapChanged <-chan struct{}
+	if w.vms != nil {
+		vmChanged = w.vms.Changed()
+	}
+	if w.configmaps != nil {
+		configmapChanged = w.configmaps.Changed()
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		case <-vmChanged:
+			if vmNames := w.vms.TakeChanged(); len(vmNames) > 0 {
+				return &syncScope{vmNames: vmNames}
+			}
+		case <-configmapChanged:
+			if httpEntries := w.configmaps.TakeChanged(); len(httpEntries) > 0 {
+				return &syncScope{httpEntries: httpEntries}
+			}
+		}
+	}
+}
+
+func getCycleType(scope *syncScope) string {
+	if scope == nil {
+		return "full"
+	}
+
+	return "targeted"
+}
+
+func startHTTPServer(address string, maxCycleAge time.Duration) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", metrics.Handler())
+	mux.Handle("/healthz", health.HealthzHandler(maxCycleAge))
+	mux.Handle("/readyz", health.ReadyzHandler())
+
+	logging.Info("Serving metrics and probes", "address", address)
+	go func() {
+		err := http.ListenAndServe(address, mux)
+		logging.Error("HTTP server stopped", logging.FieldError, err)
+		os.Exit(1)
+	}()
+}
+
+func runSyncLoop(ctx context.Context, w watchers, provider dns_api.DNSProvider, syncFrequency time.Duration) {
+	// changes queued while this replica was not syncing are covered by the first full sync
+	if w.vms != nil {
+		w.vms.TakeChanged()
+	}
+	if w.configmaps != nil {
+		w.configmaps.TakeChanged()
+	}
+
+	health.StartCycleTracking()
+	defer health.StopCycleTracking()
+
+	var scope *syncScope
+	var nextFullSync time.Time
+	for ctx.Err() == nil {
+		if scope == nil {
+			nextFullSync = time.Now().Add(syncFrequency * time.Second)
+		}
+
+		// targeted syncs leave the periodic full sync on schedule
+		logger := newCycleLogger().With("type", getCycleType(scope))
+		cycleStart := time.Now()
+		report, err := syncOnce(ctx, logger, w, provider, scope)
+		metrics.ObserveCycle(getCycleType(scope), time.Since(cycleStart), err)
+		metrics.ObserveReport(report)
+		health.MarkCycleCompleted()
+
+		var sourceErr *model.SourceError
+		switch {
+		case errors.As(err, &sourceErr):
+			logger.Error("A source is incomplete. Skipping reconciliation this cycle", "source", sourceErr.Source,
+				logging.FieldError, sourceErr.Err)
+		case err != nil:
+			logger.Error("Cycle failed. Let us retry next cycle", logging.FieldError, err,
+				"failed", report.TotalFailed(), "batches_attempted", report.Batches.Attempted,
+				"batches_succeeded", report.Batches.Succeeded)
+		default:
+			logReport(logger, report, time.Since(cycleStart))
+		}
+
+		if ctx.Err() != nil {
+			break
+		}
+
+		logger.Info("Now sleeping", "until", nextFullSync.Format(time.RFC3339))
+		scope = waitForNextSync(ctx, w, nextFullSync)
+	}
+}
+
+func startWatchers(ctx context.Context) watchers {
+	w := watchers{vcenter: dns_api.NewVCenterSession(), running: &sync.WaitGroup{}}
+
+	if dns_api.IsVMWatchEnabled() {
+		logging.Info("VM watch mode enabled. IP changes trigger an immediate sync")
+		w.vms = dns_api.NewVMWatcher(w.vcenter)
+		w.running.Add(1)
+		go func() {
+			defer w.running.Done()
+			w.vms.Run(ctx)
+		}()
+	}
+
+	if dns_api.IsConfigMapWatchEnabled() {
+		configmaps, err := dns_api.NewConfigMapWatcher()
+
+		if err != nil {
+			logging.Warn("Configmap informer could not be created. Falling back to listing every cycle",
+				logging.FieldError, err)
+		} else {
+			logging.Info("Configmap watch mode enabled. Mapping changes trigger an immediate sync")
+			w.configmaps = configmaps
+			w.running.Add(1)
+			go func() {
+				defer w.running.Done()
+				w.configmaps.Run(ctx)
+			}()
+		}
+	}
+
+	return w
+}
+
+// watcherStopTimeout - longest shutdown waits for the watchers to log out and stop
+const watcherStopTimeout = 15 * time.Second
+
+func stopWatchers(w watchers) {
+	stopped := make(chan struct{})
+	go func() {
+		w.running.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		logging.Info("Watchers stopped")
+	case <-time.After(watcherStopTimeout):
+		logging.Warn("Watchers did not stop in time. Exiting anyway", "timeout", watcherStopTimeout)
+	}
+
+	w.vcenter.Logout(logging.Default())
+}
+
+func runDaemon(ctx context.Context, args []string) int {
+	flags := flag.NewFlagSet("run", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintln(flags.Output(), "Usage: vmc-dns-sync run\n\nRuns the sync daemon. This is the default when no command is given.")
+	}
+	flags.Parse(args)
+
+	provider, err := dns_api.GetDNSProvider(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "DNS provider could not be set up: %v\n", err)
+		return 1
+	}
+
+	if _, err := dns_api.GetVCenterURL(); err != nil {
+		fmt.Fprintf(os.Stderr, "vCenter could not be set up: %v\n", err)
+		return 1
+	}
+
+	if _, err := dns_api.GetAddressSelector(); err != nil {
+		fmt.Fprintf(os.Stderr, "Address selection is invalid: %v\n", err)
+		return 1
+	}
+
+	syncFrequency := dns_api.GetSyncFrequencySeconds()
+	logging.Info("Starting DNS sync", "provider", provider.Name(), "zone", provider.Zone(),
+		"frequency_seconds", int64(syncFrequency))
+
+	startHTTPServer(dns_api.GetHTTPListenAddress(),
+		dns_api.GetLivenessMultiplier()*syncFrequency*time.Second)
+
+	w := startWatchers(ctx)
+	defer stopWatchers(w)
+
+	if !dns_api.IsLeaderElectionEnabled() {
+		runSyncLoop(ctx, w, provider, syncFrequency)
+		logging.Info("Sync stopped")
+		return 0
+	}
+
+	// a follower stays ready without having reached the components only the leader uses
+	health.SetStandby(true)
+	err = dns_api.RunLeaderElection(ctx,
+		func(leaderCtx context.Context) {
+			logging.Info("Acquired leadership. Starting sync")
+			health.SetStandby(false)
+			runSyncLoop(leaderCtx, w, provider, syncFrequency)
+		},
+		func() {
+			// the lease is given up on purpose when shutting down
+			if ctx.Err() == nil {
+				logging.Warn("Leadership lost. Exiting so a fresh replica can rejoin the election")
+			}
+		})
+
+	if err != nil {
+		logging.Error("Leader election could not be started", logging.FieldError, err)
+		return 1
+	}
+	if ctx.Err() != nil {
+		logging.Info("Sync stopped and leadership released")
+		return 0
+	}
+	logging.Error("Leader election ended")
+	return 1
+}
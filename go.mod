@@ -4,7 +4,9 @@ go 1.15
 
 require (
 	github.com/aws/aws-sdk-go v1.36.14
+	github.com/miekg/dns v1.1.30
 	github.com/pkg/errors v0.9.1
+	github.com/prometheus/client_golang v1.7.1
 	github.com/stretchr/testify v1.4.0
 	github.com/vmware/govmomi v0.24.0
 	k8s.io/api v0.19.0
@@ -1,42 +1,65 @@
 package main
 
 import (
-	"log"
-	"time"
-	"vmc-dns-sync/pkg/dns_api"
-	"vmc-dns-sync/pkg/triage"
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"vmc-dns-sync/pkg/logging"
 )
 
+func usage() {
+	fmt.Fprintln(os.Stderr, `Usage: vmc-dns-sync [command] [flags]
+
+Commands:
+  run     run the sync daemon (default)
+  plan    print the changes a sync would make, optionally saving them
+  apply   run one sync now, optionally from a saved plan
+
+Run 'vmc-dns-sync <command> -h' for the flags of a command.`)
+}
+
+// newSignalContext - context cancelled on the first SIGINT or SIGTERM. A second
+// signal gets the default behaviour again and kills the process right away
+func newSignalContext() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	go func() {
+		sig := <-signals
+		logging.Info("Received signal. Shutting down", "signal", sig.String())
+		signal.Stop(signals)
+		cancel()
+	}()
+
+	return ctx
+}
+
 func main() {
-	syncFrequency := dns_api.GetSyncFrequencySeconds()
-	log.Printf("Starting DNS sync. We will sync at frequency of %d secs\n", syncFrequency)
-
-	for {
-		awsHelper := dns_api.AWSDNSAPI{}
-		vmwNameToIPMap, err := dns_api.GetVMs()
-
-		if err != nil {
-			log.Println("Error fetching VMs")
-			log.Println(err)
-			log.Println("Let us retry next cycle")
-			continue
-		}
-		awsDNSToR53IPMap := dns_api.GetR53DNStoIPMapping()
-		k8sDNSToVMWNameMap := dns_api.GetDNStoVMMapping()
-
-		result := triage.IPTriage(vmwNameToIPMap, awsDNSToR53IPMap, k8sDNSToVMWNameMap)
-
-		err = triage.SyncRoute53(result, awsHelper)
-
-		if err != nil {
-			log.Println("Error doing final sync")
-			log.Println(err)
-			log.Println("Let us retry next cycle")
-			time.Sleep(syncFrequency * time.Second)
-			continue
-		}
-
-		log.Printf("Now sleeping for %d seconds\n", syncFrequency)
-		time.Sleep(syncFrequency * time.Second)
+	// lines libraries write through the standard logger become structured too
+	logging.RedirectStdLog()
+	command, args := "run", os.Args[1:]
+
+	if len(args) > 0 && len(args[0]) > 0 && args[0][0] != '-' {
+		command, args = args[0], args[1:]
+	}
+
+	ctx := newSignalContext()
+
+	switch command {
+	case "run":
+		os.Exit(runDaemon(ctx, args))
+	case "plan":
+		os.Exit(runPlan(ctx, args))
+	case "apply":
+		os.Exit(runApply(ctx, args))
+	case "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n", command)
+		usage()
+		os.Exit(2)
 	}
 }
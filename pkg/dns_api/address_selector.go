@@ -0,0 +1,85 @@
+package dns_api
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"vmc-dns-sync/pkg/model"
+)
+
+// Multi-homed VMs report several addresses and VMware Tools picks the
+// one in summary.guest.ipAddress arbitrarily. An address selector picks
+// from guest.net instead. The global rule comes from VMWARE_ADDRESS_*
+// env vars and every mapping can override parts of it.
+
+func splitList(value string) []string {
+	var items []string
+
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+
+	return items
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+func parseAddressSelector(networks, allowCIDRs, denyCIDRs []string, nicIndex, publishAll string) (model.AddressSelector, error) {
+	var selector model.AddressSelector
+	var err error
+
+	selector.Networks = networks
+
+	if selector.AllowCIDRs, err = parseCIDRs(allowCIDRs); err != nil {
+		return selector, fmt.Errorf("invalid allow CIDR: %v", err)
+	}
+
+	if selector.DenyCIDRs, err = parseCIDRs(denyCIDRs); err != nil {
+		return selector, fmt.Errorf("invalid deny CIDR: %v", err)
+	}
+
+	if nicIndex != "" {
+		index, err := strconv.Atoi(nicIndex)
+		if err != nil || index < 0 {
+			return selector, fmt.Errorf("invalid NIC index %q", nicIndex)
+		}
+		selector.NICIndex = &index
+	}
+
+	if publishAll != "" {
+		all, err := strconv.ParseBool(publishAll)
+		if err != nil {
+			return selector, fmt.Errorf("invalid publish all flag %q", publishAll)
+		}
+		selector.PublishAll = &all
+	}
+
+	return selector, nil
+}
+
+// GetAddressSelector - global address selection rule from VMWARE_ADDRESS_NETWORKS,
+// VMWARE_ADDRESS_ALLOW_CIDRS, VMWARE_ADDRESS_DENY_CIDRS (comma separated lists)
+// VMWARE_ADDRESS_NIC_INDEX and VMWARE_ADDRESS_PUBLISH_ALL. Empty when none is set
+func GetAddressSelector() (model.AddressSelector, error) {
+	return parseAddressSelector(
+		splitList(GetEnv("VMWARE_ADDRESS_NETWORKS")),
+		splitList(GetEnv("VMWARE_ADDRESS_ALLOW_CIDRS")),
+		splitList(GetEnv("VMWARE_ADDRESS_DENY_CIDRS")),
+		GetEnv("VMWARE_ADDRESS_NIC_INDEX"),
+		GetEnv("VMWARE_ADDRESS_PUBLISH_ALL"))
+}
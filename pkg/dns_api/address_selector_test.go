@@ -0,0 +1,68 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"vmc-dns-sync/pkg/logging"
+
+	"os"
+	"testing"
+)
+
+func TestGetAddressSelector(t *testing.T) {
+	selector, err := GetAddressSelector()
+	assert.Nil(t, err)
+	assert.True(t, selector.IsEmpty())
+
+	os.Setenv("VMWARE_ADDRESS_NETWORKS", "public, dmz ,")
+	os.Setenv("VMWARE_ADDRESS_DENY_CIDRS", "10.0.0.0/8,fd00::/8")
+	os.Setenv("VMWARE_ADDRESS_NIC_INDEX", "1")
+	defer os.Unsetenv("VMWARE_ADDRESS_NETWORKS")
+	defer os.Unsetenv("VMWARE_ADDRESS_DENY_CIDRS")
+	defer os.Unsetenv("VMWARE_ADDRESS_NIC_INDEX")
+
+	selector, err = GetAddressSelector()
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"public", "dmz"}, selector.Networks)
+	assert.Equal(t, 2, len(selector.DenyCIDRs))
+	assert.Equal(t, "10.0.0.0/8", selector.DenyCIDRs[0].String())
+	assert.Equal(t, 1, *selector.NICIndex)
+
+	os.Setenv("VMWARE_ADDRESS_ALLOW_CIDRS", "10.0.0.300/8")
+	defer os.Unsetenv("VMWARE_ADDRESS_ALLOW_CIDRS")
+	_, err = GetAddressSelector()
+	assert.NotNil(t, err)
+
+	os.Unsetenv("VMWARE_ADDRESS_ALLOW_CIDRS")
+	os.Setenv("VMWARE_ADDRESS_NIC_INDEX", "-1")
+	_, err = GetAddressSelector()
+	assert.NotNil(t, err)
+}
+
+func TestMappingAddressSelectors(t *testing.T) {
+	cm := vmStatusConfigMap("cm-1", "http://host-1", "builder-1", "deployed")
+	cm.Data["ADDRESS_NETWORKS"] = "public"
+	cm.Data["ADDRESS_NIC_INDEX"] = "0"
+	broken := vmStatusConfigMap("cm-2", "http://host-2", "builder-2", "deployed")
+	broken.Data["ADDRESS_ALLOW_CIDRS"] = "not-a-cidr"
+
+	dnsMap := getDNSMapFromConfigmaps(logging.Discard(), []v1.ConfigMap{*cm, *broken})
+	assert.Equal(t, 1, len(dnsMap))
+	assert.Equal(t, []string{"public"}, dnsMap["http://host-1"].Selector.Networks)
+	assert.Equal(t, 0, *dnsMap["http://host-1"].Selector.NICIndex)
+
+	record := vmDnsRecord("record-1", "host-1.example.com", "builder-1")
+	selector, err := getVmDnsRecordAddressSelector(*record)
+	assert.Nil(t, err)
+	assert.True(t, selector.IsEmpty())
+
+	unstructured.SetNestedField(record.Object, map[string]interface{}{
+		"allowCIDRs": []interface{}{"172.16.0.0/12"},
+		"nicIndex":   int64(2),
+	}, "spec", "addressSelection")
+	selector, err = getVmDnsRecordAddressSelector(*record)
+	assert.Nil(t, err)
+	assert.Equal(t, "172.16.0.0/12", selector.AllowCIDRs[0].String())
+	assert.Equal(t, 2, *selector.NICIndex)
+}
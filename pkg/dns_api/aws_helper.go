@@ -2,39 +2,57 @@
 package dns_api
 
 import (
+	"context"
 	"fmt"
 	"github.com/aws/aws-sdk-go/aws/awserr"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/metrics"
 	"vmc-dns-sync/pkg/model"
 
-	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
 )
 
+// AwsHelperInterface - sends one change batch to the Route53 API serving a zone
+// and waits for a sent batch to reach INSYNC
 type AwsHelperInterface interface {
-	UpdateDNSRecords(triageInput map[string]model.IPTriageSummary, awsHI AwsHelperInterface) error
-	UpdateRoute53RecordSets(r53SyncSet route53.ChangeResourceRecordSetsInput) error
+	UpdateRoute53RecordSets(ctx context.Context, zone hostedZone, r53SyncSet route53.ChangeResourceRecordSetsInput) (*route53.ChangeInfo, error)
+	WaitForChange(ctx context.Context, zone hostedZone, changeID string, deadline time.Time) error
 }
 
 type AWSDNSAPI struct {
 }
 
+// Route53Provider - DNSProvider backed by one or more Route53 hosted zones
+type Route53Provider struct {
+	awsHI AwsHelperInterface
+	zones []hostedZone
+}
+
+// NewRoute53Provider - Route53Provider using the real Route53 API for the
+// zones in R53_HOSTED_ZONES or R53_HOSTED_ZONE_ID
+func NewRoute53Provider(ctx context.Context) (Route53Provider, error) {
+	zones, err := getHostedZones(ctx)
+	if err != nil {
+		return Route53Provider{}, err
+	}
+
+	return Route53Provider{awsHI: AWSDNSAPI{}, zones: zones}, nil
+}
+
 type batchPair struct {
 	start int
 	end int
 }
 
-type dnsStruct struct {
-	dnsName string
-	dnsAction string
-	dnsIP string
-	dnsOldIP string
-}
-
 func getUpdateBatchSize() int {
 // use default 25 if nothing is present, else use env var
 	batchSize := GetEnv("R53_UPDATE_BATCH_SIZE")
@@ -52,15 +70,8 @@ func getUpdateBatchSize() int {
 	return batchSizeInt
 }
 
-func isDNSLengthOK(httpEntry string) bool {
-	workName := getAWSAName(httpEntry)
-
-	entries := strings.Split(workName, ".")
-
-	return len(entries[0]) < 64
-}
-
-func getHostedZoneID() string {
+// GetHostedZoneID - single zone the records are synced to, via R53_HOSTED_ZONE_ID
+func GetHostedZoneID() string {
 	return GetEnv("R53_HOSTED_ZONE_ID")
 }
 
@@ -83,9 +94,12 @@ func getAWSAName(routeName string) string {
 }
 
 func getAWSAction(triageAction int) string {
-// translate our triage action to AWS term
+// translate our triage action to AWS term. Adds are creates, so a record
+// made since the zone was read fails the batch instead of being taken over
 	switch triageAction {
-	case model.IPTriageAddR53, model.IPTriageUpdateR53:
+	case model.IPTriageAddR53:
+		return "CREATE"
+	case model.IPTriageUpdateR53:
 		return "UPSERT"
 	case model.IPTriageDeleteR53:
 		return "DELETE"
@@ -126,96 +140,183 @@ func getBatchPairs(sampleSize, batchSize int) []batchPair {
 	return pairList
 }
 
-func createRoute53Session(awsRegion string) *route53.Route53 {
+func getRoute53Endpoint() string {
+	// optional endpoint override - useful for local Route53 stand-ins
+	return GetEnv("R53_ENDPOINT_URL")
+}
+
+func createRoute53Session(zone hostedZone, configs ...*aws.Config) *route53.Route53 {
+	// zones in other regions or accounts bring their own region and role
+	awsRegion := zone.region
+	if awsRegion == "" {
+		awsRegion = getAWSRegion()
+	}
+
 	awsSession := session.Must(session.NewSession())
 	*awsSession.Config.Region = awsRegion
-	return route53.New(awsSession)
-}
 
-func getRoute53Records() map[string]string {
-// get route 53 records we are interested in and translate it
-// into a simple route-ip dictionary
-	manager := createRoute53Session(getAWSRegion())
-	hostedZoneID := getHostedZoneID()
+	if endpoint := getRoute53Endpoint(); endpoint != "" {
+		awsSession.Config.Endpoint = aws.String(endpoint)
+	}
 
-	if  hostedZoneID == "" {
-		log.Panic("Hosted zone was expected and not provided via env var R53_HOSTED_ZONE_ID")
+	if zone.roleARN != "" {
+		awsSession.Config.Credentials = stscreds.NewCredentials(awsSession, zone.roleARN)
 	}
 
+	return route53.New(awsSession, configs...)
+}
+
+func listRoute53Records(ctx context.Context, logger *logging.Logger, manager route53iface.Route53API,
+	hostedZoneID string) ([]*route53.ResourceRecordSet, error) {
+// Route53 returns at most 300 records per call. Walk every page
+// so large zones are not silently truncated
+	var recordSets []*route53.ResourceRecordSet
+	pages := 0
+
 	input := &route53.ListResourceRecordSetsInput{
 		HostedZoneId: aws.String(hostedZoneID),
-		StartRecordName: aws.String("A"),
 	}
 
-	hostedZone, _ := manager.ListResourceRecordSets(input)
+	err := manager.ListResourceRecordSetsPagesWithContext(ctx, input,
+		func(page *route53.ListResourceRecordSetsOutput, lastPage bool) bool {
+			pages++
+			recordSets = append(recordSets, page.ResourceRecordSets...)
+			return true
+		})
 
-	var record *route53.ResourceRecordSet
-	var i int
-	var dnsMap map[string]string
-	dnsMap = make(map[string]string)
+	logger.Info("Read hosted zone records", "records", len(recordSets), "pages", pages)
+	return recordSets, err
+}
 
-	for i, record = range hostedZone.ResourceRecordSets {
-		log.Println(*record.Name, *record.ResourceRecords[0].Value)
+func getRoute53Records(ctx context.Context, logger *logging.Logger, zones []hostedZone) (map[string]model.DNSRecord, error) {
+// get route 53 records of every zone we are interested in and translate
+// them into a simple route to record dictionary
+	var dnsMap map[string]model.DNSRecord
+	dnsMap = make(map[string]model.DNSRecord)
+
+	for _, zone := range zones {
+		// a zone that cannot be read fails the whole listing. Its
+		// records would otherwise look missing and be re-added elsewhere
+		if err := addZoneRecords(ctx, logger.With(logging.FieldZone, zone.id), dnsMap, zone, zones); err != nil {
+			return nil, err
+		}
+	}
+
+	return dnsMap, nil
+}
+
+func addZoneRecords(ctx context.Context, logger *logging.Logger, dnsMap map[string]model.DNSRecord, zone hostedZone, zones []hostedZone) error {
+	manager := createRoute53Session(zone)
+
+	logger.Info("Reading hosted zone")
+	recordSets, err := listRoute53Records(ctx, logger, manager, zone.id)
+	health.SetComponent(health.ComponentDNS, err)
 
-		httpIP := *record.ResourceRecords[0].Value
-		if strings.HasPrefix(httpIP, "ns") {
-			log.Println("Ignoring NS record", httpIP)
+	if err != nil {
+		return fmt.Errorf("listing hosted zone %s failed: %v", zone.id, err)
+	}
+
+	ownedNames := getOwnedNames(recordSets)
+	logger.Info("Found owned records", "count", countOwnedNames(ownedNames), "owner", getOwnerID())
+	inZone := func(recordName string) bool {
+		routed, _ := routeToZone(zones, recordName)
+		return routed.id == zone.id
+	}
+
+	for _, record := range recordSets {
+		recordType := aws.StringValue(record.Type)
+		if (recordType != route53.RRTypeA && recordType != route53.RRTypeAaaa) || len(record.ResourceRecords) == 0 {
 			continue
 		}
 
-		httpRoute := "http://" + strings.TrimRight(*record.Name, ".")
-		log.Printf("Adding route to map: %s - %s\n", httpRoute, httpIP)
-		dnsMap[httpRoute] = httpIP
+		recordName := strings.TrimRight(*record.Name, ".")
+		var values []string
+		for _, resourceRecord := range record.ResourceRecords {
+			values = append(values, aws.StringValue(resourceRecord.Value))
+		}
+		httpIP := model.JoinIPs(values)
+
+		// a parent zone may still hold records of a delegated child zone
+		if !inZone(recordName) {
+			logger.Debug("Ignoring record routed to another zone", logging.FieldRecordType, recordType,
+				logging.FieldHostname, recordName)
+			continue
+		}
+
+		httpRoute := "http://" + recordName
+		owned := ownedNames[model.RecordKey(recordName, recordType)]
+		if !owned {
+			logger.Debug("Found record not owned by us", logging.FieldRecordType, recordType,
+				logging.FieldHostname, recordName, "ip", httpIP)
+		} else {
+			logger.Debug("Adding route to map", logging.FieldRecordType, recordType, logging.FieldHostname, httpRoute, "ip", httpIP)
+		}
+		dnsMap[model.RecordKey(httpRoute, recordType)] = model.DNSRecord{
+			IPs:     httpIP,
+			TTL:     aws.Int64Value(record.TTL),
+			Unowned: !owned,
+		}
 	}
 
-	log.Printf("Processed %d records", i + 1)
-	return dnsMap
+	addForeignClaims(dnsMap, ownedNames, inZone)
+	return nil
 }
 
-// GetR53DNStoIPMapping - get dict map of http to ip
-func GetR53DNStoIPMapping() map[string]string {
+// Name - provider name for logs
+func (p Route53Provider) Name() string {
+	return "route53"
+}
 
-	log.Println("Syncing Route 53 entries")
-	recordSets := getRoute53Records()
+// Zone - hosted zones the records are synced to. The zone ID when there is only one
+func (p Route53Provider) Zone() string {
+	return describeHostedZones(p.zones)
+}
 
-	return recordSets
+// ListRecords - A and AAAA record sets of all hosted zones by record key
+func (p Route53Provider) ListRecords(ctx context.Context, logger *logging.Logger) (map[string]model.DNSRecord, error) {
+	logger.Info("Syncing Route 53 entries")
+	return getRoute53Records(ctx, logger, p.zones)
 }
 
-func getR53UpdateSet(entries []dnsStruct) route53.ChangeResourceRecordSetsInput {
+func getR53UpdateSet(logger *logging.Logger, hostedZoneID string, entries []model.DNSChange) route53.ChangeResourceRecordSetsInput {
 	var finalReturn route53.ChangeResourceRecordSetsInput
 	var changeBatch route53.ChangeBatch
 	var changeList []*route53.Change
 
-	hostedZone := getHostedZoneID()
-	finalReturn.HostedZoneId = &hostedZone
+	finalReturn.HostedZoneId = aws.String(hostedZoneID)
 
 
 	for _, eachDNS := range entries{
 		var currentChange route53.Change
 		var recordSet route53.ResourceRecordSet
 		var ipValue string
+		var ttl int64
+		dnsAction := getAWSAction(eachDNS.Action)
 
-		if eachDNS.dnsAction == "DELETE" {
-			ipValue = eachDNS.dnsOldIP
+		// a DELETE must match the record set exactly, TTL included
+		if dnsAction == "DELETE" {
+			ipValue, ttl = eachDNS.OldIP, eachDNS.OldTTL
 		} else {
-			ipValue = eachDNS.dnsIP
+			ipValue, ttl = eachDNS.IP, eachDNS.TTL
 		}
 
-		log.Printf("Action: %s, DNS: %s, IP: %s\n", eachDNS.dnsAction, eachDNS.dnsName, ipValue)
+		logger.Info("Queueing change", logging.FieldAction, dnsAction, logging.FieldRecordType, eachDNS.RecordType,
+			logging.FieldHostname, eachDNS.Name, logging.FieldOldIP, eachDNS.OldIP, logging.FieldNewIP, eachDNS.IP, "ttl", ttl)
 
-		recordSet.Name = aws.String(eachDNS.dnsName)
-		recordSet.ResourceRecords = []*route53.ResourceRecord{
-			{
-				Value: aws.String(ipValue),
-			},
+		recordSet.Name = aws.String(eachDNS.Name)
+		for _, ip := range model.SplitIPs(ipValue) {
+			recordSet.ResourceRecords = append(recordSet.ResourceRecords, &route53.ResourceRecord{
+				Value: aws.String(ip),
+			})
 		}
-		recordSet.TTL = aws.Int64(60)
-		recordSet.Type = aws.String("A")
+		recordSet.TTL = aws.Int64(ttl)
+		recordSet.Type = aws.String(eachDNS.RecordType)
 
-		currentChange.Action = aws.String(eachDNS.dnsAction)
+		currentChange.Action = aws.String(dnsAction)
 		currentChange.ResourceRecordSet = &recordSet
 
-		changeList = append(changeList, &currentChange)
+		changeList = append(changeList, &currentChange,
+			getOwnershipChange(dnsAction, eachDNS.Name, eachDNS.RecordType))
 	}
 
 	changeBatch.Changes = changeList
@@ -224,84 +325,158 @@ func getR53UpdateSet(entries []dnsStruct) route53.ChangeResourceRecordSetsInput
 	return finalReturn
 }
 
-func(a AWSDNSAPI) UpdateRoute53RecordSets(r53SyncSet route53.ChangeResourceRecordSetsInput) error {
-	manager := createRoute53Session(getAWSRegion())
+func getAWSErrorCode(err error) string {
+	// error code for reporting. Empty when there is no error
+	if err == nil {
+		return ""
+	}
+
+	if aerr, ok := err.(awserr.Error); ok {
+		return aerr.Code()
+	}
 
-	_, err := manager.ChangeResourceRecordSets(&r53SyncSet)
+	return "Unknown"
+}
+
+func(a AWSDNSAPI) UpdateRoute53RecordSets(ctx context.Context, zone hostedZone, r53SyncSet route53.ChangeResourceRecordSetsInput) (*route53.ChangeInfo, error) {
+	// the caller retries throttled and pending batches with its own backoff.
+	// SDK retries on top of that would multiply the attempts
+	manager := createRoute53Session(zone, aws.NewConfig().WithMaxRetries(0))
 
+	// errors are logged by the caller, with the batch they belong to
+	output, err := manager.ChangeResourceRecordSetsWithContext(ctx, &r53SyncSet)
 	if err != nil {
-		if aerr, ok := err.(awserr.Error); ok {
-			switch aerr.Code() {
-			case route53.ErrCodeNoSuchHostedZone:
-				log.Println(route53.ErrCodeNoSuchHostedZone, aerr.Error())
-			case route53.ErrCodeNoSuchHealthCheck:
-				log.Println(route53.ErrCodeNoSuchHealthCheck, aerr.Error())
-			case route53.ErrCodeInvalidChangeBatch:
-				log.Println(route53.ErrCodeInvalidChangeBatch, aerr.Error())
-			case route53.ErrCodeInvalidInput:
-				log.Println(route53.ErrCodeInvalidInput, aerr.Error())
-			case route53.ErrCodePriorRequestNotComplete:
-				log.Println(route53.ErrCodePriorRequestNotComplete, aerr.Error())
-			default:
-				log.Println(aerr.Error())
-			}
-		} else {
-			// Print the error, cast err to awserr.Error to get the Code and
-			// Message from an error.
-			log.Println(err.Error())
-		}
+		return nil, err
 	}
 
-	return err
+	return output.ChangeInfo, nil
 }
 
-func(a AWSDNSAPI) UpdateDNSRecords(triageInput map[string]model.IPTriageSummary,
-							awsHI AwsHelperInterface) error {
-	var r53DNSList []dnsStruct
-
-	for _, triage := range triageInput {
-		if triage.Result != model.IPTriageNoChange {
-			if isDNSLengthOK(triage.HttpEntry) {
-				r53DNSList = append(
-					r53DNSList,
-					dnsStruct{
-						dnsName:   getAWSAName(triage.HttpEntry),
-						dnsAction: getAWSAction(triage.Result),
-						dnsIP:     triage.VmwIP,
-						dnsOldIP:  triage.R53IP,
-					},
-				)
-			} else {
-				log.Printf("%s is too long. AWS will reject this - so let us instead\n", triage.HttpEntry)
-			}
+// ApplyChanges - sends the changes to the hosted zone of each hostname,
+// in batches of R53_UPDATE_BATCH_SIZE per zone. A change whose mapping names
+// a zone is only sent when that is the zone its hostname is routed to
+func (p Route53Provider) ApplyChanges(ctx context.Context, logger *logging.Logger,
+	changes []model.DNSChange) (model.BatchCounts, error) {
+	var batches model.BatchCounts
+	zoneChanges := make(map[string][]int)
+
+	for i, change := range changes {
+		zone, ok := routeToZone(p.zones, change.Name)
+		if !ok {
+			logger.Warn("Hostname is outside every configured hosted zone. Skipping", logging.FieldHostname, change.Name)
+			changes[i].Error = "no hosted zone for " + change.Name
+			continue
 		}
+		if change.Zone != "" && !zone.isNamed(change.Zone) {
+			logger.Warn("Hostname is routed to another zone than its mapping names. Skipping", logging.FieldHostname,
+				change.Name, logging.FieldZone, zone.id, "mapping_zone", change.Zone)
+			changes[i].Error = fmt.Sprintf("hostname is routed to zone %s, not %s", zone.id, change.Zone)
+			continue
+		}
+		zoneChanges[zone.id] = append(zoneChanges[zone.id], i)
 	}
 
-	if len(r53DNSList) == 0 {
-		log.Println("No action encountered after processing. All records seem to be in sync. Exiting without action")
-		return fmt.Errorf("DNS000: No action to take")
+	var sent []sentBatch
+	for _, zone := range p.zones {
+		if len(zoneChanges[zone.id]) > 0 {
+			zoneSent, attempted := p.applyZoneChanges(ctx, logger.With(logging.FieldZone, zone.id), zone, changes, zoneChanges[zone.id])
+			batches.Attempted += attempted
+			sent = append(sent, zoneSent...)
+		}
 	}
 
-	errorPresent := false
-	updatePairs := getBatchPairs(len(r53DNSList), getUpdateBatchSize())
+	// batches propagate in parallel, so wait only once all zones have been sent to
+	if isWaitForInsync() {
+		p.waitForBatches(ctx, logger, changes, sent)
+	}
 
-	for i, eachPair := range updatePairs {
-		log.Printf("Set %d, Start Range %d, End Range %d\n", i + 1, eachPair.start, eachPair.end - 1)
-		updatableRecordSet := getR53UpdateSet(r53DNSList[eachPair.start:eachPair.end])
-		err := awsHI.UpdateRoute53RecordSets(updatableRecordSet)
-		if err != nil {
-			errorPresent = true
-			log.Println("Last set sync failed. Error was logged already. Not panicking...")
-		} else {
-			log.Println("Last set was successful.")
+	// a batch succeeded when it was accepted and, if waited for, propagated
+	for _, batch := range sent {
+		if changes[batch.indexes[0]].Error == "" {
+			batches.Succeeded++
 		}
 	}
 
-	if errorPresent {
-		return fmt.Errorf("DNS001: At least one set of updates failed")
+	return batches, model.NewBatchError(changes)
+}
+
+// sentBatch - change batch accepted by Route53, for waiting on it
+type sentBatch struct {
+	zone     hostedZone
+	indexes  []int
+	changeID string
+	sentAt   time.Time
+}
+
+func (p Route53Provider) applyZoneChanges(ctx context.Context, logger *logging.Logger, zone hostedZone,
+	changes []model.DNSChange, indexes []int) ([]sentBatch, int) {
+	// sends the changes at indexes to one zone. Returns the batches Route53 accepted and the number attempted
+	attempted := 0
+	updatePairs := getBatchPairs(len(indexes), getUpdateBatchSize())
+	var sent []sentBatch
+
+	for i, eachPair := range updatePairs {
+		// on shutdown leave the remaining batches for the next run to pick up
+		if ctx.Err() != nil {
+			logger.Warn("Shutting down. Not sending the remaining change sets", "sets", len(updatePairs) - i)
+			for _, index := range indexes[eachPair.start:] {
+				changes[index].Error = errShutdown.Error()
+			}
+			break
+		}
+
+		setLogger := logger.With("set", i + 1)
+		setLogger.Info("Sending change set", "start", eachPair.start, "end", eachPair.end - 1)
+		var batch []model.DNSChange
+		for _, index := range indexes[eachPair.start:eachPair.end] {
+			batch = append(batch, changes[index])
+		}
+
+		changeInfo, err := p.sendBatch(ctx, setLogger, zone, getR53UpdateSet(setLogger, zone.id, batch))
+		sentAt := time.Now()
+		attempted++
+
+		// record the outcome against each change so it can be reported back
+		for _, index := range indexes[eachPair.start:eachPair.end] {
+			if err != nil {
+				changes[index].Error = err.Error()
+			} else if changeInfo != nil {
+				changes[index].ChangeID = aws.StringValue(changeInfo.Id)
+			}
+		}
+
+		if err == nil && changeInfo != nil {
+			sent = append(sent, sentBatch{zone: zone, indexes: indexes[eachPair.start:eachPair.end],
+				changeID: aws.StringValue(changeInfo.Id), sentAt: sentAt})
+		}
 	}
 
-	return nil
+	return sent, attempted
 }
 
+func (p Route53Provider) waitForBatches(ctx context.Context, logger *logging.Logger, changes []model.DNSChange, sent []sentBatch) {
+	// waits for each sent batch to be INSYNC, failing its changes when it was not in time.
+	// All batches share one deadline, so a cycle waits R53_INSYNC_TIMEOUT_SECONDS at most
+	deadline := time.Now().Add(getInsyncTimeout())
+
+	for _, batch := range sent {
+		err := p.awsHI.WaitForChange(ctx, batch.zone, batch.changeID, deadline)
+		propagation := time.Since(batch.sentAt)
+		metrics.ObservePropagation(propagation, err)
+
+		batchLogger := logger.With(logging.FieldZone, batch.zone.id)
+		if err != nil {
+			batchLogger.Error("Change did not propagate", "change_id", batch.changeID, logging.FieldError, err)
+		} else {
+			batchLogger.Info("Change is INSYNC", "change_id", batch.changeID, "propagation", propagation.Round(time.Second))
+		}
 
+		for _, index := range batch.indexes {
+			if err != nil {
+				changes[index].Error = err.Error()
+			} else {
+				changes[index].Propagation = propagation
+			}
+		}
+	}
+}
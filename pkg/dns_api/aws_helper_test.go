@@ -2,10 +2,22 @@ package dns_api
 
 import (
 	"github.com/stretchr/testify/assert"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"vmc-dns-sync/pkg/logging"
 	"vmc-dns-sync/pkg/model"
 
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"path"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestRegionValue(t *testing.T) {
@@ -34,13 +46,20 @@ func TestRoute53Formatter(t *testing.T) {
 }
 
 func TestAWSActions(t *testing.T) {
-	assert.Equal(t, "UPSERT", getAWSAction(model.IPTriageAddR53))
+	assert.Equal(t, "CREATE", getAWSAction(model.IPTriageAddR53))
 	assert.Equal(t, "DELETE", getAWSAction(model.IPTriageDeleteR53))
 	assert.Equal(t, "UPSERT", getAWSAction(model.IPTriageUpdateR53))
 	assert.Equal(t, "UNKNOWN", getAWSAction(model.IPTriageNoChange))
 	assert.Equal(t, "UNKNOWN", getAWSAction(400))
 }
 
+func TestAWSErrorCodes(t *testing.T) {
+	assert.Equal(t, "", getAWSErrorCode(nil))
+	assert.Equal(t, "Unknown", getAWSErrorCode(fmt.Errorf("plain error")))
+	assert.Equal(t, route53.ErrCodeThrottlingException,
+		getAWSErrorCode(awserr.New(route53.ErrCodeThrottlingException, "Rate exceeded", nil)))
+}
+
 func TestBatching(t *testing.T) {
 	sample := make([]int, 100)
 
@@ -91,4 +110,210 @@ func TestBatching(t *testing.T) {
 	assert.Equal(t, 91, pairs[6].end)
 	assert.Equal(t, 91, pairs[7].start)
 	assert.Equal(t, 100, pairs[7].end)
-}
\ No newline at end of file
+}
+type fakeRecord struct {
+	Name   string
+	Type   string
+	TTL    int64
+	Values []string
+}
+
+// fakeZones - the single zone startFakeRoute53 configures
+var fakeZones = []hostedZone{{id: "ZFAKE"}}
+
+// fakeRoute53 - minimal local stand-in for the Route53 REST API.
+// Serves ListResourceRecordSets in pages of pageSize records. Zones other
+// than ZFAKE are served from zoneRecords
+type fakeRoute53 struct {
+	records     []fakeRecord
+	zoneRecords map[string][]fakeRecord
+	pageSize    int
+	listCalls   int
+}
+
+func (f *fakeRoute53) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/rrset") {
+		f.listCalls++
+		records := f.records
+		if zoneID := path.Base(path.Dir(r.URL.Path)); zoneID != "ZFAKE" {
+			var ok bool
+			if records, ok = f.zoneRecords[zoneID]; !ok {
+				http.Error(w, "<ErrorResponse><Error><Code>NoSuchHostedZone</Code></Error></ErrorResponse>", http.StatusNotFound)
+				return
+			}
+		}
+		f.listRecordSets(w, r, records)
+		return
+	}
+
+	http.Error(w, "not implemented by fake", http.StatusNotImplemented)
+}
+
+func (f *fakeRoute53) listRecordSets(w http.ResponseWriter, r *http.Request, records []fakeRecord) {
+	start := 0
+	startName := r.URL.Query().Get("name")
+	startType := r.URL.Query().Get("type")
+
+	if startName != "" {
+		for i, record := range records {
+			if record.Name == startName && (startType == "" || record.Type == startType) {
+				start = i
+				break
+			}
+		}
+	}
+
+	end := start + f.pageSize
+	truncated := end < len(records)
+	if !truncated {
+		end = len(records)
+	}
+
+	var body strings.Builder
+	body.WriteString(`<?xml version="1.0" encoding="UTF-8"?>`)
+	body.WriteString(`<ListResourceRecordSetsResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/">`)
+	body.WriteString(`<ResourceRecordSets>`)
+	for _, record := range records[start:end] {
+		fmt.Fprintf(&body, `<ResourceRecordSet><Name>%s</Name><Type>%s</Type><TTL>%d</TTL><ResourceRecords>`,
+			record.Name, record.Type, record.TTL)
+		for _, value := range record.Values {
+			fmt.Fprintf(&body, `<ResourceRecord><Value>%s</Value></ResourceRecord>`, html.EscapeString(value))
+		}
+		body.WriteString(`</ResourceRecords></ResourceRecordSet>`)
+	}
+	body.WriteString(`</ResourceRecordSets>`)
+	fmt.Fprintf(&body, `<IsTruncated>%t</IsTruncated><MaxItems>%d</MaxItems>`, truncated, f.pageSize)
+	if truncated {
+		fmt.Fprintf(&body, `<NextRecordName>%s</NextRecordName><NextRecordType>%s</NextRecordType>`,
+			records[end].Name, records[end].Type)
+	}
+	body.WriteString(`</ListResourceRecordSetsResponse>`)
+
+	w.Header().Set("Content-Type", "text/xml")
+	w.Write([]byte(body.String()))
+}
+
+func fakeOwnershipRecord(dnsName, ownerID string) fakeRecord {
+	return fakeRecord{
+		Name:   ownershipRecordPrefix + dnsName + ".",
+		Type:   "TXT",
+		TTL:    ownershipRecordTTL,
+		Values: []string{fmt.Sprintf("\"heritage=vmc-dns-sync,owner=%s\"", ownerID)},
+	}
+}
+
+func startFakeRoute53(t *testing.T, fake *fakeRoute53) {
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	os.Setenv("AWS_ACCESS_KEY_ID", "fake-key")
+	os.Setenv("AWS_SECRET_ACCESS_KEY", "fake-secret")
+	os.Setenv("R53_ENDPOINT_URL", server.URL)
+	os.Setenv("R53_HOSTED_ZONE_ID", "ZFAKE")
+	t.Cleanup(func() {
+		os.Unsetenv("R53_ENDPOINT_URL")
+		os.Unsetenv("R53_HOSTED_ZONE_ID")
+	})
+}
+
+func TestRoute53Pagination(t *testing.T) {
+	fake := &fakeRoute53{pageSize: 2}
+	fake.records = append(fake.records,
+		fakeRecord{Name: "example.com.", Type: "NS", TTL: 172800, Values: []string{"ns-1.awsdns-00.com."}},
+		fakeRecord{Name: "example.com.", Type: "SOA", TTL: 900, Values: []string{"ns-1.awsdns-00.com. awsdns-hostmaster.amazon.com. 1 7200 900 1209600 86400"}},
+	)
+	for i := 0; i < 7; i++ {
+		fake.records = append(fake.records, fakeRecord{
+			Name:   fmt.Sprintf("host-%d.example.com.", i),
+			Type:   "A",
+			TTL:    60,
+			Values: []string{fmt.Sprintf("10.0.0.%d", i)},
+		}, fakeOwnershipRecord(fmt.Sprintf("host-%d.example.com", i), getOwnerID()))
+	}
+	startFakeRoute53(t, fake)
+
+	dnsMap, err := getRoute53Records(context.Background(), logging.Discard(), fakeZones)
+
+	assert.Nil(t, err)
+	assert.Equal(t, 8, fake.listCalls)
+	assert.Equal(t, 7, len(dnsMap))
+	for i := 0; i < 7; i++ {
+		assert.Equal(t, fmt.Sprintf("10.0.0.%d", i), dnsMap[fmt.Sprintf("http://host-%d.example.com", i)].IPs)
+	}
+}
+
+func TestRoute53ListingFailure(t *testing.T) {
+	fake := &fakeRoute53{pageSize: 100}
+	startFakeRoute53(t, fake)
+
+	// a zone that cannot be listed is an error for the caller, not a crash
+	dnsMap, err := getRoute53Records(context.Background(), logging.Discard(), []hostedZone{{id: "ZMISSING"}})
+
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "ZMISSING"))
+	assert.Nil(t, dnsMap)
+}
+
+type fakeBatchSender struct {
+	batches [][]*route53.Change
+	zones   []string
+	err     error
+	waited  []string
+	waitErr error
+	// deadline of each WaitForChange call
+	deadlines []time.Time
+}
+
+func (f *fakeBatchSender) UpdateRoute53RecordSets(ctx context.Context, zone hostedZone, r53SyncSet route53.ChangeResourceRecordSetsInput) (*route53.ChangeInfo, error) {
+	f.batches = append(f.batches, r53SyncSet.ChangeBatch.Changes)
+	f.zones = append(f.zones, aws.StringValue(r53SyncSet.HostedZoneId))
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	return &route53.ChangeInfo{Id: aws.String(fmt.Sprintf("/change/C%d", len(f.batches)))}, nil
+}
+
+func (f *fakeBatchSender) WaitForChange(ctx context.Context, zone hostedZone, changeID string, deadline time.Time) error {
+	f.waited = append(f.waited, changeID)
+	f.deadlines = append(f.deadlines, deadline)
+	if changeID == "/change/C2" {
+		return f.waitErr
+	}
+
+	return nil
+}
+
+// applyErr - error of ApplyChanges, for tests that do not look at the batch counts
+func applyErr(_ model.BatchCounts, err error) error {
+	return err
+}
+
+func TestRoute53ProviderApplyChanges(t *testing.T) {
+	os.Setenv("R53_UPDATE_BATCH_SIZE", "2")
+	defer os.Unsetenv("R53_UPDATE_BATCH_SIZE")
+
+	sender := &fakeBatchSender{}
+	provider := Route53Provider{awsHI: sender, zones: fakeZones}
+	changes := []model.DNSChange{
+		{Key: "http://a.example.com", Name: "a.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.1"},
+		{Key: "http://b.example.com", Name: "b.example.com", RecordType: "A", Action: model.IPTriageUpdateR53, IP: "10.0.0.2", OldIP: "10.0.0.9"},
+		{Key: "http://c.example.com", Name: "c.example.com", RecordType: "A", Action: model.IPTriageDeleteR53, OldIP: "10.0.0.3"},
+	}
+
+	batches, err := provider.ApplyChanges(context.Background(), logging.Discard(), changes)
+	assert.Nil(t, err)
+	assert.Equal(t, model.BatchCounts{Attempted: 2, Succeeded: 2}, batches)
+	assert.Equal(t, 2, len(sender.batches))
+	assert.Equal(t, "/change/C1", changes[0].ChangeID)
+	assert.Equal(t, "/change/C1", changes[1].ChangeID)
+	assert.Equal(t, "/change/C2", changes[2].ChangeID)
+	assert.Equal(t, "DELETE", aws.StringValue(sender.batches[1][0].Action))
+
+	sender = &fakeBatchSender{err: fmt.Errorf("throttled")}
+	provider = Route53Provider{awsHI: sender, zones: fakeZones}
+	batches, err = provider.ApplyChanges(context.Background(), logging.Discard(), changes[:1])
+	assert.Equal(t, &model.BatchError{Failed: 1, Total: 1}, err)
+	assert.Equal(t, model.BatchCounts{Attempted: 1}, batches)
+	assert.Equal(t, "throttled", changes[0].Error)
+}
@@ -0,0 +1,78 @@
+package dns_api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// A sent change batch is PENDING until Route53 has propagated it to all its
+// name servers. With R53_WAIT_FOR_INSYNC the cycle polls GetChange until the
+// batch is INSYNC. A batch still PENDING R53_INSYNC_TIMEOUT_SECONDS after the
+// cycle started waiting fails its changes, although Route53 will usually still apply it later
+
+// poll intervals, doubling from the first up to the max. Vars so tests can shorten them
+var insyncPollInterval = 2 * time.Second
+var insyncMaxPollInterval = 15 * time.Second
+
+func isWaitForInsync() bool {
+	return strings.ToUpper(GetEnv("R53_WAIT_FOR_INSYNC")) == "TRUE"
+}
+
+func getInsyncTimeout() time.Duration {
+	// use default 300 seconds if nothing valid is present, else use env var
+	timeout, err := strconv.Atoi(GetEnv("R53_INSYNC_TIMEOUT_SECONDS"))
+
+	if err != nil || timeout <= 0 {
+		return 300 * time.Second
+	}
+
+	return time.Duration(timeout) * time.Second
+}
+
+// waitForChange - polls the change until it is INSYNC. An error when it is
+// still PENDING at deadline, cannot be read or ctx is cancelled first
+func waitForChange(ctx context.Context, manager route53iface.Route53API, changeID string, deadline time.Time) error {
+	interval := insyncPollInterval
+
+	for {
+		output, err := manager.GetChangeWithContext(ctx, &route53.GetChangeInput{Id: aws.String(changeID)})
+		if err != nil {
+			return fmt.Errorf("reading change %s failed: %v", changeID, err)
+		}
+
+		status := aws.StringValue(output.ChangeInfo.Status)
+		if status == route53.ChangeStatusInsync {
+			return nil
+		}
+
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return fmt.Errorf("change %s still %s at the INSYNC deadline", changeID, status)
+		}
+
+		if interval > remaining {
+			interval = remaining
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("stopped waiting for change %s, still %s: %v", changeID, status, ctx.Err())
+		case <-time.After(interval):
+		}
+
+		interval *= 2
+		if interval > insyncMaxPollInterval {
+			interval = insyncMaxPollInterval
+		}
+	}
+}
+
+func (a AWSDNSAPI) WaitForChange(ctx context.Context, zone hostedZone, changeID string, deadline time.Time) error {
+	return waitForChange(ctx, createRoute53Session(zone), changeID, deadline)
+}
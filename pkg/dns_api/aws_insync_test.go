@@ -0,0 +1,121 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// fakeChangeStatus - Route53 API answering GetChange with PENDING for the
+// first pending calls and INSYNC after
+type fakeChangeStatus struct {
+	route53iface.Route53API
+	pending int
+	calls   int
+	err     error
+}
+
+func (f *fakeChangeStatus) GetChangeWithContext(ctx aws.Context, input *route53.GetChangeInput, opts ...request.Option) (*route53.GetChangeOutput, error) {
+	f.calls++
+	if f.err != nil {
+		return nil, f.err
+	}
+
+	status := route53.ChangeStatusInsync
+	if f.calls <= f.pending {
+		status = route53.ChangeStatusPending
+	}
+
+	return &route53.GetChangeOutput{ChangeInfo: &route53.ChangeInfo{Id: input.Id, Status: aws.String(status)}}, nil
+}
+
+func TestInsyncSettings(t *testing.T) {
+	assert.False(t, isWaitForInsync())
+	assert.Equal(t, 300*time.Second, getInsyncTimeout())
+
+	os.Setenv("R53_WAIT_FOR_INSYNC", "true")
+	defer os.Unsetenv("R53_WAIT_FOR_INSYNC")
+	os.Setenv("R53_INSYNC_TIMEOUT_SECONDS", "90")
+	defer os.Unsetenv("R53_INSYNC_TIMEOUT_SECONDS")
+	assert.True(t, isWaitForInsync())
+	assert.Equal(t, 90*time.Second, getInsyncTimeout())
+
+	os.Setenv("R53_INSYNC_TIMEOUT_SECONDS", "-1")
+	assert.Equal(t, 300*time.Second, getInsyncTimeout())
+}
+
+func TestWaitForChange(t *testing.T) {
+	defer func(first, max time.Duration) {
+		insyncPollInterval, insyncMaxPollInterval = first, max
+	}(insyncPollInterval, insyncMaxPollInterval)
+	insyncPollInterval, insyncMaxPollInterval = time.Millisecond, 4*time.Millisecond
+
+	status := &fakeChangeStatus{pending: 3}
+	assert.Nil(t, waitForChange(context.Background(), status, "/change/C1", time.Now().Add(time.Second)))
+	assert.Equal(t, 4, status.calls)
+
+	status = &fakeChangeStatus{pending: 1000}
+	err := waitForChange(context.Background(), status, "/change/C1", time.Now().Add(20*time.Millisecond))
+	assert.Equal(t, "change /change/C1 still PENDING at the INSYNC deadline", err.Error())
+
+	status = &fakeChangeStatus{err: fmt.Errorf("throttled")}
+	err = waitForChange(context.Background(), status, "/change/C1", time.Now().Add(time.Second))
+	assert.Equal(t, "reading change /change/C1 failed: throttled", err.Error())
+	assert.Equal(t, 1, status.calls)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	status = &fakeChangeStatus{pending: 1000}
+	err = waitForChange(ctx, status, "/change/C1", time.Now().Add(time.Second))
+	assert.Equal(t, "stopped waiting for change /change/C1, still PENDING: context canceled", err.Error())
+}
+
+func TestApplyChangesWaitsForInsync(t *testing.T) {
+	os.Setenv("R53_UPDATE_BATCH_SIZE", "2")
+	defer os.Unsetenv("R53_UPDATE_BATCH_SIZE")
+
+	changes := func() []model.DNSChange {
+		return []model.DNSChange{
+			{Name: "a.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.1"},
+			{Name: "b.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.2"},
+			{Name: "c.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.3"},
+		}
+	}
+
+	// not waited for unless asked
+	sender := &fakeBatchSender{}
+	assert.Nil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(context.Background(), logging.Discard(), changes())))
+	assert.Empty(t, sender.waited)
+
+	os.Setenv("R53_WAIT_FOR_INSYNC", "TRUE")
+	defer os.Unsetenv("R53_WAIT_FOR_INSYNC")
+
+	sender = &fakeBatchSender{}
+	applied := changes()
+	assert.Nil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(context.Background(), logging.Discard(), applied)))
+	assert.Equal(t, []string{"/change/C1", "/change/C2"}, sender.waited)
+	// the batches share one deadline rather than getting the full timeout each
+	assert.Equal(t, sender.deadlines[0], sender.deadlines[1])
+	assert.NotZero(t, applied[0].Propagation)
+	assert.NotZero(t, applied[2].Propagation)
+
+	// a batch still pending at the timeout fails its changes only
+	sender = &fakeBatchSender{waitErr: fmt.Errorf("change /change/C2 still PENDING at the INSYNC deadline")}
+	applied = changes()
+	err := applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(context.Background(), logging.Discard(), applied))
+	assert.IsType(t, &model.BatchError{}, err)
+	assert.Equal(t, "", applied[1].Error)
+	assert.Equal(t, "/change/C2", applied[2].ChangeID)
+	assert.Equal(t, "change /change/C2 still PENDING at the INSYNC deadline", applied[2].Error)
+	assert.Zero(t, applied[2].Propagation)
+}
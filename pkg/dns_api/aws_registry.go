@@ -0,0 +1,144 @@
+package dns_api
+
+import (
+	"fmt"
+	"strings"
+	"vmc-dns-sync/pkg/model"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Every A and AAAA record we write is accompanied by a TXT record that
+// marks it as ours (similar to the external-dns TXT registry). Only records
+// carrying a matching ownership TXT are handed over to triage as records to
+// sync. Hand-made records, and names another owner claims, are handed over
+// as unowned so that triage leaves them alone rather than writing over them.
+// Each record type has its own TXT so that deleting one never orphans the other.
+
+const ownershipRecordPrefix = "_vmc-dns-sync."
+const ownershipRecordPrefixAAAA = "_vmc-dns-sync-aaaa."
+const ownershipRecordTTL = 300
+
+func getOwnershipRecordPrefix(recordType string) string {
+	if recordType == model.RecordTypeAAAA {
+		return ownershipRecordPrefixAAAA
+	}
+
+	return ownershipRecordPrefix
+}
+
+func parseOwnershipRecordName(recordName string) (string, string, bool) {
+	// name and record type an ownership TXT stands for
+	for _, recordType := range []string{model.RecordTypeA, model.RecordTypeAAAA} {
+		prefix := getOwnershipRecordPrefix(recordType)
+		if strings.HasPrefix(recordName, prefix) {
+			return strings.TrimPrefix(recordName, prefix), recordType, true
+		}
+	}
+
+	return "", "", false
+}
+
+func getOwnerID() string {
+	// use default owner if nothing is present, else use env var
+	ownerID := GetEnv("R53_OWNER_ID")
+
+	if ownerID == "" {
+		return "vmc-dns-sync"
+	}
+
+	return ownerID
+}
+
+func getOwnershipRecordName(dnsName, recordType string) string {
+	return getOwnershipRecordPrefix(recordType) + getAWSAName(dnsName)
+}
+
+func getOwnershipText() string {
+	return fmt.Sprintf("heritage=vmc-dns-sync,owner=%s", getOwnerID())
+}
+
+func getOwnershipValue() string {
+	// TXT values must be quoted when submitted to Route53
+	return "\"" + getOwnershipText() + "\""
+}
+
+func getOwnedNames(recordSets []*route53.ResourceRecordSet) map[string]bool {
+	// walk the ownership TXT records and return the record keys of the
+	// names (without the trailing ".") they claim: true for the names
+	// that belong to this owner, false for those of another owner
+	owned := make(map[string]bool)
+	ownershipValue := getOwnershipValue()
+
+	for _, record := range recordSets {
+		if aws.StringValue(record.Type) != route53.RRTypeTxt {
+			continue
+		}
+
+		recordName, recordType, ok := parseOwnershipRecordName(getAWSAName(aws.StringValue(record.Name)))
+		if !ok {
+			continue
+		}
+
+		key := model.RecordKey(recordName, recordType)
+		owned[key] = owned[key]
+		for _, value := range record.ResourceRecords {
+			if aws.StringValue(value.Value) == ownershipValue {
+				owned[key] = true
+				break
+			}
+		}
+	}
+
+	return owned
+}
+
+func countOwnedNames(owned map[string]bool) int {
+	count := 0
+	for _, ours := range owned {
+		if ours {
+			count++
+		}
+	}
+
+	return count
+}
+
+// addForeignClaims - adds the names another owner claims as unowned records,
+// unless a record of theirs was listed already. routed tells whether a name
+// belongs to the zone being listed
+func addForeignClaims(dnsMap map[string]model.DNSRecord, owned map[string]bool, routed func(name string) bool) {
+	for key, ours := range owned {
+		recordName, recordType := model.SplitRecordKey(key)
+		httpKey := model.RecordKey("http://"+recordName, recordType)
+
+		if _, listed := dnsMap[httpKey]; ours || listed || !routed(recordName) {
+			continue
+		}
+		dnsMap[httpKey] = model.DNSRecord{Unowned: true}
+	}
+}
+
+func getOwnershipChange(dnsAction, dnsName, recordType string) *route53.Change {
+	// companion TXT change for an A record change. Deletes must carry
+	// the exact value, which is always ours since we only delete owned records.
+	// A TXT of ours left behind without its record is taken over on create
+	if dnsAction == route53.ChangeActionCreate {
+		dnsAction = route53.ChangeActionUpsert
+	}
+
+	return &route53.Change{
+		Action: aws.String(dnsAction),
+		ResourceRecordSet: &route53.ResourceRecordSet{
+			Name: aws.String(getOwnershipRecordName(dnsName, recordType)),
+			ResourceRecords: []*route53.ResourceRecord{
+				{
+					Value: aws.String(getOwnershipValue()),
+				},
+			},
+			TTL:  aws.Int64(ownershipRecordTTL),
+			Type: aws.String(route53.RRTypeTxt),
+		},
+	}
+}
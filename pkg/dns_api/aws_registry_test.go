@@ -0,0 +1,125 @@
+package dns_api
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/stretchr/testify/assert"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"os"
+	"testing"
+)
+
+func TestOwnerID(t *testing.T) {
+	assert.Equal(t, "vmc-dns-sync", getOwnerID())
+	assert.Equal(t, "\"heritage=vmc-dns-sync,owner=vmc-dns-sync\"", getOwnershipValue())
+
+	os.Setenv("R53_OWNER_ID", "site-a")
+	defer os.Unsetenv("R53_OWNER_ID")
+	assert.Equal(t, "site-a", getOwnerID())
+	assert.Equal(t, "\"heritage=vmc-dns-sync,owner=site-a\"", getOwnershipValue())
+}
+
+func TestOwnershipRecordName(t *testing.T) {
+	assert.Equal(t, "_vmc-dns-sync.www.google.com", getOwnershipRecordName("www.google.com", "A"))
+	assert.Equal(t, "_vmc-dns-sync.www.google.com", getOwnershipRecordName("http://www.google.com.", "A"))
+	assert.Equal(t, "_vmc-dns-sync-aaaa.www.google.com", getOwnershipRecordName("www.google.com", "AAAA"))
+
+	name, recordType, ok := parseOwnershipRecordName("_vmc-dns-sync-aaaa.www.google.com")
+	assert.True(t, ok)
+	assert.Equal(t, "www.google.com", name)
+	assert.Equal(t, "AAAA", recordType)
+
+	_, _, ok = parseOwnershipRecordName("www.google.com")
+	assert.False(t, ok)
+}
+
+func TestOnlyOwnedRecordsReturned(t *testing.T) {
+	fake := &fakeRoute53{pageSize: 100}
+	fake.records = []fakeRecord{
+		{Name: "hand-made.example.com.", Type: "A", TTL: 300, Values: []string{"10.1.0.1"}},
+		{Name: "owned.example.com.", Type: "A", TTL: 60, Values: []string{"10.1.0.2"}},
+		{Name: "owned.example.com.", Type: "AAAA", TTL: 60, Values: []string{"2001:db8::2"}},
+		{Name: "v6-only.example.com.", Type: "AAAA", TTL: 60, Values: []string{"2001:db8::5"}},
+		{Name: "other-owner.example.com.", Type: "A", TTL: 60, Values: []string{"10.1.0.3"}},
+		{Name: "txt-only.example.com.", Type: "TXT", TTL: 60, Values: []string{"\"v=spf1 -all\""}},
+		fakeOwnershipRecord("owned.example.com", getOwnerID()),
+		{Name: "_vmc-dns-sync-aaaa.v6-only.example.com.", Type: "TXT", TTL: 300, Values: []string{getOwnershipValue()}},
+		fakeOwnershipRecord("other-owner.example.com", "someone-else"),
+		fakeOwnershipRecord("claimed.example.com", "someone-else"),
+	}
+	startFakeRoute53(t, fake)
+
+	dnsMap, err := getRoute53Records(context.Background(), logging.Discard(), fakeZones)
+
+	assert.Nil(t, err)
+	assert.Equal(t, model.DNSRecord{IPs: "10.1.0.2", TTL: 60}, dnsMap["http://owned.example.com"])
+	assert.Equal(t, model.DNSRecord{IPs: "2001:db8::5", TTL: 60}, dnsMap["http://v6-only.example.com#AAAA"])
+
+	// everything else is listed as unowned, so triage never writes over it.
+	// The AAAA record of owned.example.com has no ownership TXT of its own
+	assert.Equal(t, 6, len(dnsMap))
+	assert.Equal(t, model.DNSRecord{IPs: "10.1.0.1", TTL: 300, Unowned: true}, dnsMap["http://hand-made.example.com"])
+	assert.Equal(t, model.DNSRecord{IPs: "2001:db8::2", TTL: 60, Unowned: true}, dnsMap["http://owned.example.com#AAAA"])
+	assert.Equal(t, model.DNSRecord{IPs: "10.1.0.3", TTL: 60, Unowned: true}, dnsMap["http://other-owner.example.com"])
+	assert.Equal(t, model.DNSRecord{Unowned: true}, dnsMap["http://claimed.example.com"])
+}
+
+func TestUpdateSetCarriesOwnership(t *testing.T) {
+	updateSet := getR53UpdateSet(logging.Discard(), "ZFAKE", []model.DNSChange{
+		{Name: "add.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.2.0.1"},
+		{Name: "gone.example.com", RecordType: "A", Action: model.IPTriageDeleteR53, OldIP: "10.2.0.2"},
+		{Name: "add.example.com", RecordType: "AAAA", Action: model.IPTriageAddR53, IP: "2001:db8::1"},
+	})
+
+	changes := updateSet.ChangeBatch.Changes
+	assert.Equal(t, 6, len(changes))
+
+	// adds create the record, failing the batch if someone else made it meanwhile
+	assert.Equal(t, "CREATE", aws.StringValue(changes[0].Action))
+	assert.Equal(t, "UPSERT", aws.StringValue(changes[1].Action))
+	assert.Equal(t, route53.RRTypeTxt, aws.StringValue(changes[1].ResourceRecordSet.Type))
+	assert.Equal(t, "_vmc-dns-sync.add.example.com", aws.StringValue(changes[1].ResourceRecordSet.Name))
+	assert.Equal(t, getOwnershipValue(), aws.StringValue(changes[1].ResourceRecordSet.ResourceRecords[0].Value))
+
+	assert.Equal(t, "DELETE", aws.StringValue(changes[2].Action))
+	assert.Equal(t, route53.RRTypeA, aws.StringValue(changes[2].ResourceRecordSet.Type))
+	assert.Equal(t, "10.2.0.2", aws.StringValue(changes[2].ResourceRecordSet.ResourceRecords[0].Value))
+	assert.Equal(t, "DELETE", aws.StringValue(changes[3].Action))
+	assert.Equal(t, "_vmc-dns-sync.gone.example.com", aws.StringValue(changes[3].ResourceRecordSet.Name))
+
+	assert.Equal(t, route53.RRTypeAaaa, aws.StringValue(changes[4].ResourceRecordSet.Type))
+	assert.Equal(t, "2001:db8::1", aws.StringValue(changes[4].ResourceRecordSet.ResourceRecords[0].Value))
+	assert.Equal(t, "_vmc-dns-sync-aaaa.add.example.com", aws.StringValue(changes[5].ResourceRecordSet.Name))
+}
+
+func TestMultiValueRecordSets(t *testing.T) {
+	fake := &fakeRoute53{pageSize: 100}
+	fake.records = []fakeRecord{
+		{Name: "pool.example.com.", Type: "A", TTL: 60, Values: []string{"10.3.0.2", "10.3.0.1"}},
+		fakeOwnershipRecord("pool.example.com", getOwnerID()),
+	}
+	startFakeRoute53(t, fake)
+
+	dnsMap, err := getRoute53Records(context.Background(), logging.Discard(), fakeZones)
+
+	assert.Nil(t, err)
+	assert.Equal(t, "10.3.0.1,10.3.0.2", dnsMap["http://pool.example.com"].IPs)
+
+	updateSet := getR53UpdateSet(logging.Discard(), "ZFAKE", []model.DNSChange{
+		{Name: "pool.example.com", RecordType: "A", Action: model.IPTriageUpdateR53,
+			IP: "10.3.0.1,10.3.0.2,10.3.0.3", OldIP: "10.3.0.1,10.3.0.2", TTL: 300, OldTTL: 60},
+		{Name: "gone.example.com", RecordType: "A", Action: model.IPTriageDeleteR53,
+			OldIP: "10.3.0.4", TTL: 300, OldTTL: 120},
+	})
+
+	recordSet := updateSet.ChangeBatch.Changes[0].ResourceRecordSet
+	assert.Equal(t, 3, len(recordSet.ResourceRecords))
+	assert.Equal(t, "10.3.0.3", aws.StringValue(recordSet.ResourceRecords[2].Value))
+	assert.Equal(t, int64(300), aws.Int64Value(recordSet.TTL))
+
+	// deletes have to name the TTL the record set has
+	assert.Equal(t, int64(120), aws.Int64Value(updateSet.ChangeBatch.Changes[2].ResourceRecordSet.TTL))
+}
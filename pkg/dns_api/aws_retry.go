@@ -0,0 +1,126 @@
+package dns_api
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"time"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/metrics"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// Route53 throttles change batches per account and refuses a batch while an
+// earlier one is still PENDING. Such batches are retried with jittered
+// exponential backoff, up to R53_RETRY_ATTEMPTS attempts in all, rather than
+// waiting for the next cycle. A batch Route53 rejects as invalid is never
+// retried, since it would fail the same way every time. The SDK's own retryer
+// is turned off for these calls so R53_RETRY_ATTEMPTS is the real limit
+
+// backoff before the nth retry is between half and all of retryBaseDelay * 2^(n-1),
+// capped at retryMaxDelay. Vars so tests can shorten them
+var retryBaseDelay = time.Second
+var retryMaxDelay = 20 * time.Second
+
+func getRetryAttempts() int {
+	// use default 5 if nothing valid is present, else use env var
+	attempts, err := strconv.Atoi(GetEnv("R53_RETRY_ATTEMPTS"))
+
+	if err != nil || attempts < 1 {
+		return 5
+	}
+
+	return attempts
+}
+
+func isRetryableAWSError(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch aerr.Code() {
+	case route53.ErrCodeInvalidChangeBatch, route53.ErrCodeInvalidInput, route53.ErrCodeNoSuchHostedZone:
+		return false
+	case route53.ErrCodePriorRequestNotComplete, "ServiceUnavailable", "InternalError":
+		return true
+	}
+
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+func getRetryDelay(retry int) time.Duration {
+	ceiling := retryMaxDelay
+	if retry < 16 && retryBaseDelay<<uint(retry-1) < ceiling {
+		ceiling = retryBaseDelay << uint(retry-1)
+	}
+
+	half := ceiling / 2
+	return half + time.Duration(rand.Int63n(int64(ceiling-half)+1))
+}
+
+// batchSendTimeout - longest a single ChangeResourceRecordSets call may take.
+// On shutdown the call is not cancelled: once sent, a batch is applied by
+// Route53 as a whole, so it is better to learn its outcome than to abandon it.
+// A lost Lease does cancel it, as the new leader may already be writing
+const batchSendTimeout = 30 * time.Second
+
+// sendBatch - sends one change batch, retrying while Route53 answers with a
+// retryable error. The error says why the batch was finally given up on.
+// Cancelling ctx stops further attempts but lets the one in flight finish
+func (p Route53Provider) sendBatch(ctx context.Context, logger *logging.Logger, zone hostedZone,
+	r53SyncSet route53.ChangeResourceRecordSetsInput) (*route53.ChangeInfo, error) {
+	attempts := getRetryAttempts()
+
+	leaseCtx := getLeaseContext(ctx)
+
+	for attempt := 1; ; attempt++ {
+		if leaseCtx.Err() != nil {
+			logger.Warn("Leadership lost. Not sending change set", "attempts", attempt-1)
+			return nil, fmt.Errorf("not sent after %d attempts, leadership lost", attempt-1)
+		}
+
+		sendCtx, cancel := context.WithTimeout(leaseCtx, batchSendTimeout)
+		changeInfo, err := p.awsHI.UpdateRoute53RecordSets(sendCtx, zone, r53SyncSet)
+		cancel()
+		errorCode := getAWSErrorCode(err)
+
+		switch {
+		case err == nil:
+			metrics.ObserveBatch("")
+			logger.Info("Change set sent", "attempts", attempt)
+			return changeInfo, nil
+
+		case errorCode == route53.ErrCodeInvalidChangeBatch:
+			metrics.ObserveBatch(errorCode)
+			logger.Error("Change set rejected as invalid. Not retrying", "error_code", errorCode, logging.FieldError, err)
+			return nil, err
+
+		case !isRetryableAWSError(err):
+			metrics.ObserveBatch(errorCode)
+			logger.Error("Change set failed with a non-retryable error", "error_code", errorCode, logging.FieldError, err)
+			return nil, err
+
+		case attempt >= attempts:
+			metrics.ObserveBatch(errorCode)
+			logger.Error("Change set still failing. Giving up", "attempts", attempt, "error_code", errorCode,
+				logging.FieldError, err)
+			return nil, fmt.Errorf("%v (gave up after %d attempts)", err, attempt)
+		}
+
+		delay := getRetryDelay(attempt)
+		metrics.ObserveBatchRetry(errorCode)
+		logger.Warn("Change set failed. Retrying", "attempt", attempt, "error_code", errorCode, "delay", delay)
+
+		select {
+		case <-ctx.Done():
+			logger.Warn("Shutting down. Abandoning change set", "attempts", attempt)
+			return nil, fmt.Errorf("%v (abandoned after %d attempts, shutting down)", err, attempt)
+		case <-time.After(delay):
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// scriptedSender - answers each batch attempt with the next error of the
+// script, and succeeds once the script runs out. onSend, when set, runs on every attempt
+type scriptedSender struct {
+	errs     []error
+	attempts int
+	onSend   func()
+	ctxErr   error
+}
+
+func (s *scriptedSender) UpdateRoute53RecordSets(ctx context.Context, zone hostedZone, r53SyncSet route53.ChangeResourceRecordSetsInput) (*route53.ChangeInfo, error) {
+	s.attempts++
+	if s.onSend != nil {
+		s.onSend()
+	}
+	s.ctxErr = ctx.Err()
+	if s.attempts <= len(s.errs) {
+		return nil, s.errs[s.attempts-1]
+	}
+
+	return &route53.ChangeInfo{Id: aws.String("/change/C1")}, nil
+}
+
+func (s *scriptedSender) WaitForChange(ctx context.Context, zone hostedZone, changeID string, deadline time.Time) error {
+	return nil
+}
+
+func TestRetryableAWSErrors(t *testing.T) {
+	for _, code := range []string{route53.ErrCodePriorRequestNotComplete, "Throttling", route53.ErrCodeThrottlingException,
+		"ServiceUnavailable", "RequestTimeout"} {
+		assert.True(t, isRetryableAWSError(awserr.New(code, "", nil)), code)
+	}
+
+	for _, code := range []string{route53.ErrCodeInvalidChangeBatch, route53.ErrCodeInvalidInput, route53.ErrCodeNoSuchHostedZone,
+		"AccessDenied"} {
+		assert.False(t, isRetryableAWSError(awserr.New(code, "", nil)), code)
+	}
+	assert.False(t, isRetryableAWSError(fmt.Errorf("throttled")))
+}
+
+func TestChangeSessionHasNoSDKRetries(t *testing.T) {
+	// backoff is up to sendBatch alone, the SDK would retry throttling again
+	assert.Equal(t, 0, createRoute53Session(hostedZone{}, aws.NewConfig().WithMaxRetries(0)).MaxRetries())
+	assert.NotEqual(t, 0, createRoute53Session(hostedZone{}).MaxRetries())
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert.Equal(t, 5, getRetryAttempts())
+	os.Setenv("R53_RETRY_ATTEMPTS", "2")
+	assert.Equal(t, 2, getRetryAttempts())
+	os.Unsetenv("R53_RETRY_ATTEMPTS")
+
+	for retry, ceiling := range map[int]time.Duration{1: time.Second, 3: 4 * time.Second, 6: 20 * time.Second, 60: 20 * time.Second} {
+		delay := getRetryDelay(retry)
+		assert.True(t, delay >= ceiling/2 && delay <= ceiling, "retry %d waited %v", retry, delay)
+	}
+}
+
+func TestSendBatchRetries(t *testing.T) {
+	defer func(base, max time.Duration) {
+		retryBaseDelay, retryMaxDelay = base, max
+	}(retryBaseDelay, retryMaxDelay)
+	retryBaseDelay, retryMaxDelay = time.Millisecond, 2*time.Millisecond
+
+	changes := []model.DNSChange{{Name: "a.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.1"}}
+	prior := awserr.New(route53.ErrCodePriorRequestNotComplete, "still pending", nil)
+
+	sender := &scriptedSender{errs: []error{prior, awserr.New("Throttling", "rate exceeded", nil)}}
+	assert.Nil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(context.Background(), logging.Discard(), changes)))
+	assert.Equal(t, 3, sender.attempts)
+	assert.Equal(t, "/change/C1", changes[0].ChangeID)
+
+	os.Setenv("R53_RETRY_ATTEMPTS", "3")
+	defer os.Unsetenv("R53_RETRY_ATTEMPTS")
+	sender = &scriptedSender{errs: []error{prior, prior, prior, prior}}
+	assert.NotNil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(context.Background(), logging.Discard(), changes)))
+	assert.Equal(t, 3, sender.attempts)
+	assert.Equal(t, "PriorRequestNotComplete: still pending (gave up after 3 attempts)", changes[0].Error)
+
+	// an invalid batch fails the same way every time
+	sender = &scriptedSender{errs: []error{awserr.New(route53.ErrCodeInvalidChangeBatch, "record exists", nil)}}
+	assert.NotNil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(context.Background(), logging.Discard(), changes)))
+	assert.Equal(t, 1, sender.attempts)
+	assert.Equal(t, "InvalidChangeBatch: record exists", changes[0].Error)
+}
+
+func TestShutdownStopsSending(t *testing.T) {
+	os.Setenv("R53_UPDATE_BATCH_SIZE", "1")
+	defer os.Unsetenv("R53_UPDATE_BATCH_SIZE")
+
+	changes := []model.DNSChange{
+		{Name: "a.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.1"},
+		{Name: "b.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.2"},
+	}
+
+	// the batch in flight when the signal arrives is still sent, the rest are not
+	ctx, cancel := context.WithCancel(context.Background())
+	sender := &scriptedSender{onSend: cancel}
+	assert.NotNil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(ctx, logging.Discard(), changes)))
+	assert.Equal(t, 1, sender.attempts)
+	assert.Equal(t, "/change/C1", changes[0].ChangeID)
+	assert.Equal(t, "not sent: shutting down", changes[1].Error)
+
+	// a batch waiting to be retried is abandoned rather than retried
+	changes[0].ChangeID, changes[1].Error = "", ""
+	ctx, cancel = context.WithCancel(context.Background())
+	sender = &scriptedSender{errs: []error{awserr.New(route53.ErrCodePriorRequestNotComplete, "still pending", nil)}, onSend: cancel}
+	assert.NotNil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(ctx, logging.Discard(), changes)))
+	assert.Equal(t, 1, sender.attempts)
+	assert.Equal(t, "PriorRequestNotComplete: still pending (abandoned after 1 attempts, shutting down)", changes[0].Error)
+	assert.Equal(t, "not sent: shutting down", changes[1].Error)
+}
+
+func TestLostLeaseStopsSending(t *testing.T) {
+	os.Setenv("R53_UPDATE_BATCH_SIZE", "1")
+	defer os.Unsetenv("R53_UPDATE_BATCH_SIZE")
+
+	changes := []model.DNSChange{
+		{Name: "a.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.1"},
+		{Name: "b.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.2"},
+	}
+
+	// unlike a shutdown, losing the Lease cancels the batch in flight: the new leader may be writing
+	leaseCtx, loseLease := context.WithCancel(context.Background())
+	ctx := context.WithValue(context.Background(), leaseContextKey{}, leaseCtx)
+	sender := &scriptedSender{onSend: loseLease}
+	assert.NotNil(t, applyErr(Route53Provider{awsHI: sender, zones: fakeZones}.ApplyChanges(ctx, logging.Discard(), changes)))
+	assert.Equal(t, 1, sender.attempts)
+	assert.Equal(t, context.Canceled, sender.ctxErr)
+	assert.Equal(t, "not sent after 0 attempts, leadership lost", changes[1].Error)
+}
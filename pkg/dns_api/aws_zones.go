@@ -0,0 +1,238 @@
+package dns_api
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"vmc-dns-sync/pkg/logging"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+)
+
+// Hostnames are routed to a hosted zone by the longest matching suffix.
+// R53_HOSTED_ZONES holds the map as `suffix=zoneID[,region[,roleARN]]`
+// entries separated by semicolons, so zones can live in other regions or
+// accounts. Without it, R53_HOSTED_ZONE_ID is a single zone taking every
+// hostname. Instead of the ID, R53_HOSTED_ZONE_NAME names the zone by
+// domain and it is looked up at startup.
+
+// hostedZone - one Route53 hosted zone and the hostnames routed to it
+type hostedZone struct {
+	// suffix - hostnames ending in it go to this zone. Empty takes every hostname
+	suffix  string
+	id      string
+	region  string
+	roleARN string
+	// name - domain of a zone looked up by R53_HOSTED_ZONE_NAME
+	name string
+}
+
+func parseHostedZones(value string) ([]hostedZone, error) {
+	var zones []hostedZone
+	seen := make(map[string]bool)
+
+	for _, entry := range strings.Split(value, ";") {
+		if entry = strings.TrimSpace(entry); entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("hosted zone entry %q is not suffix=zoneID", entry)
+		}
+
+		fields := strings.Split(parts[1], ",")
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("hosted zone entry %q has more than zoneID, region and role ARN", entry)
+		}
+		for i := range fields {
+			fields[i] = strings.TrimSpace(fields[i])
+		}
+		fields = append(fields, "", "")
+
+		zone := hostedZone{
+			suffix:  strings.ToLower(getAWSAName(strings.TrimSpace(parts[0]))),
+			id:      fields[0],
+			region:  fields[1],
+			roleARN: fields[2],
+		}
+
+		if zone.id == "" {
+			return nil, fmt.Errorf("hosted zone entry %q has no zone ID", entry)
+		}
+		if seen[zone.suffix] {
+			return nil, fmt.Errorf("suffix %q is mapped to more than one hosted zone", zone.suffix)
+		}
+		seen[zone.suffix] = true
+
+		zones = append(zones, zone)
+	}
+
+	return zones, nil
+}
+
+func getHostedZones(ctx context.Context) ([]hostedZone, error) {
+	zones, err := parseHostedZones(GetEnv("R53_HOSTED_ZONES"))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(zones) > 0 {
+		return zones, nil
+	}
+
+	if hostedZoneID := GetHostedZoneID(); hostedZoneID != "" {
+		return []hostedZone{{id: hostedZoneID}}, nil
+	}
+
+	if domain := getHostedZoneName(); domain != "" {
+		vpcID := GetEnv("R53_HOSTED_ZONE_VPC_ID")
+		hostedZoneID, err := discoverHostedZone(ctx, createRoute53Session(hostedZone{}), domain, isPrivateHostedZone(), vpcID)
+		if err != nil {
+			return nil, err
+		}
+
+		logging.Info("Resolved hosted zone by name", "domain", domain, logging.FieldZone, hostedZoneID)
+		return []hostedZone{{id: hostedZoneID, name: strings.ToLower(getAWSAName(domain))}}, nil
+	}
+
+	return nil, fmt.Errorf("hosted zone was expected and not provided via env var R53_HOSTED_ZONE_ID, " +
+		"R53_HOSTED_ZONE_NAME or R53_HOSTED_ZONES")
+}
+
+func getHostedZoneName() string {
+	return GetEnv("R53_HOSTED_ZONE_NAME")
+}
+
+func isPrivateHostedZone() bool {
+	// a VPC only makes sense for private zones, so it implies one
+	return strings.ToUpper(GetEnv("R53_HOSTED_ZONE_PRIVATE")) == "TRUE" || GetEnv("R53_HOSTED_ZONE_VPC_ID") != ""
+}
+
+func isZoneInVPC(ctx context.Context, manager route53iface.Route53API, hostedZoneID, vpcID string) (bool, error) {
+	output, err := manager.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{Id: aws.String(hostedZoneID)})
+	if err != nil {
+		return false, err
+	}
+
+	for _, vpc := range output.VPCs {
+		if aws.StringValue(vpc.VPCId) == vpcID {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// discoverHostedZone - ID of the one hosted zone named domain with the given
+// visibility and, for private zones, associated with vpcID when one is given.
+// Zero or several matches are an error, since guessing could sync to the wrong zone
+func discoverHostedZone(ctx context.Context, manager route53iface.Route53API, domain string, private bool,
+	vpcID string) (string, error) {
+	dnsName := strings.ToLower(getAWSAName(domain)) + "."
+	input := &route53.ListHostedZonesByNameInput{DNSName: aws.String(dnsName)}
+	var matches []string
+
+	for {
+		output, err := manager.ListHostedZonesByNameWithContext(ctx, input)
+		if err != nil {
+			return "", fmt.Errorf("looking up hosted zone %s failed: %v", dnsName, err)
+		}
+
+		// zones come sorted by name starting at dnsName, so stop at the first other name
+		done := !aws.BoolValue(output.IsTruncated)
+		for _, zone := range output.HostedZones {
+			if strings.ToLower(aws.StringValue(zone.Name)) != dnsName {
+				done = true
+				break
+			}
+
+			zoneID := strings.TrimPrefix(aws.StringValue(zone.Id), "/hostedzone/")
+			isPrivate := zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone)
+			if isPrivate != private {
+				continue
+			}
+
+			if private && vpcID != "" {
+				inVPC, err := isZoneInVPC(ctx, manager, zoneID, vpcID)
+				if err != nil {
+					return "", fmt.Errorf("reading hosted zone %s failed: %v", zoneID, err)
+				}
+				if !inVPC {
+					continue
+				}
+			}
+
+			matches = append(matches, zoneID)
+		}
+
+		if done {
+			break
+		}
+		input.DNSName = output.NextDNSName
+		input.HostedZoneId = output.NextHostedZoneId
+	}
+
+	visibility := "public"
+	if private {
+		visibility = "private"
+	}
+	if vpcID != "" {
+		visibility += " (VPC " + vpcID + ")"
+	}
+
+	switch len(matches) {
+	case 0:
+		return "", fmt.Errorf("no %s hosted zone named %s", visibility, dnsName)
+	case 1:
+		return matches[0], nil
+	}
+
+	return "", fmt.Errorf("%d %s hosted zones are named %s: %s. Set R53_HOSTED_ZONE_ID to pick one",
+		len(matches), visibility, dnsName, strings.Join(matches, ", "))
+}
+
+func (z hostedZone) matches(dnsName string) bool {
+	dnsName = strings.ToLower(dnsName)
+
+	return z.suffix == "" || dnsName == z.suffix || strings.HasSuffix(dnsName, "."+z.suffix)
+}
+
+// isNamed - whether a zone named in a mapping is this one, by ID, suffix or domain
+func (z hostedZone) isNamed(zone string) bool {
+	zone = strings.ToLower(getAWSAName(zone))
+
+	return zone == strings.ToLower(z.id) || (z.suffix != "" && zone == z.suffix) || (z.name != "" && zone == z.name)
+}
+
+// routeToZone - zone with the longest suffix matching the name
+func routeToZone(zones []hostedZone, dnsName string) (hostedZone, bool) {
+	var best hostedZone
+	found := false
+
+	for _, zone := range zones {
+		if zone.matches(dnsName) && (!found || len(zone.suffix) > len(best.suffix)) {
+			best, found = zone, true
+		}
+	}
+
+	return best, found
+}
+
+func describeHostedZones(zones []hostedZone) string {
+	// a single zone is named by its ID alone, as before zone maps existed
+	if len(zones) == 1 && zones[0].suffix == "" {
+		return zones[0].id
+	}
+
+	var entries []string
+	for _, zone := range zones {
+		entries = append(entries, zone.suffix+"="+zone.id)
+	}
+	sort.Strings(entries)
+
+	return strings.Join(entries, ";")
+}
@@ -0,0 +1,216 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/aws/aws-sdk-go/service/route53/route53iface"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestHostedZoneSettings(t *testing.T) {
+	_, err := getHostedZones(context.Background())
+	assert.NotNil(t, err)
+
+	os.Setenv("R53_HOSTED_ZONE_ID", "ZLEGACY")
+	defer os.Unsetenv("R53_HOSTED_ZONE_ID")
+	zones, err := getHostedZones(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []hostedZone{{id: "ZLEGACY"}}, zones)
+	assert.Equal(t, "ZLEGACY", describeHostedZones(zones))
+
+	os.Setenv("R53_HOSTED_ZONES", "example.com=Z1; Corp.Example.com.=Z2,eu-west-1,arn:aws:iam::123456789012:role/dns-sync;")
+	defer os.Unsetenv("R53_HOSTED_ZONES")
+	zones, err = getHostedZones(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []hostedZone{
+		{suffix: "example.com", id: "Z1"},
+		{suffix: "corp.example.com", id: "Z2", region: "eu-west-1", roleARN: "arn:aws:iam::123456789012:role/dns-sync"},
+	}, zones)
+	assert.Equal(t, "corp.example.com=Z2;example.com=Z1", describeHostedZones(zones))
+
+	for _, invalid := range []string{"example.com", "example.com=", "example.com=Z1;example.com=Z2", "a=Z1,r,role,extra"} {
+		_, err = parseHostedZones(invalid)
+		assert.NotNil(t, err, invalid)
+	}
+}
+
+func TestRouteToZone(t *testing.T) {
+	zones := []hostedZone{{suffix: "example.com", id: "Z1"}, {suffix: "corp.example.com", id: "Z2"}}
+
+	zone, ok := routeToZone(zones, "build-1.example.com")
+	assert.True(t, ok)
+	assert.Equal(t, "Z1", zone.id)
+
+	zone, _ = routeToZone(zones, "Build-1.Corp.Example.com")
+	assert.Equal(t, "Z2", zone.id)
+
+	zone, _ = routeToZone(zones, "corp.example.com")
+	assert.Equal(t, "Z2", zone.id)
+
+	_, ok = routeToZone(zones, "build-1.notexample.com")
+	assert.False(t, ok)
+
+	zone, ok = routeToZone([]hostedZone{{id: "ZALL"}}, "anything.example.org")
+	assert.True(t, ok)
+	assert.Equal(t, "ZALL", zone.id)
+}
+
+func TestMultiZoneRecords(t *testing.T) {
+	fake := &fakeRoute53{pageSize: 100}
+	fake.zoneRecords = map[string][]fakeRecord{
+		"Z1": {
+			{Name: "a.example.com.", Type: "A", TTL: 60, Values: []string{"10.0.0.1"}},
+			fakeOwnershipRecord("a.example.com", getOwnerID()),
+			// left over from before corp.example.com was delegated
+			{Name: "b.corp.example.com.", Type: "A", TTL: 60, Values: []string{"10.0.9.9"}},
+			fakeOwnershipRecord("b.corp.example.com", getOwnerID()),
+		},
+		"Z2": {
+			{Name: "b.corp.example.com.", Type: "A", TTL: 60, Values: []string{"10.0.1.2"}},
+			fakeOwnershipRecord("b.corp.example.com", getOwnerID()),
+		},
+	}
+	startFakeRoute53(t, fake)
+	zones := []hostedZone{{suffix: "example.com", id: "Z1"}, {suffix: "corp.example.com", id: "Z2"}}
+
+	dnsMap, err := getRoute53Records(context.Background(), logging.Discard(), zones)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, fake.listCalls)
+	assert.Equal(t, map[string]model.DNSRecord{
+		"http://a.example.com":      {IPs: "10.0.0.1", TTL: 60},
+		"http://b.corp.example.com": {IPs: "10.0.1.2", TTL: 60},
+	}, dnsMap)
+
+	// a zone that cannot be listed fails the whole read
+	_, err = getRoute53Records(context.Background(), logging.Discard(), append(zones, hostedZone{suffix: "other.com", id: "ZMISSING"}))
+	assert.NotNil(t, err)
+}
+
+func TestMultiZoneApplyChanges(t *testing.T) {
+	sender := &fakeBatchSender{}
+	provider := Route53Provider{awsHI: sender, zones: []hostedZone{
+		{suffix: "example.com", id: "Z1"},
+		{suffix: "corp.example.com", id: "Z2"},
+	}}
+	changes := []model.DNSChange{
+		{Name: "a.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.1"},
+		{Name: "b.corp.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.1.2"},
+		{Name: "c.example.com", RecordType: "A", Action: model.IPTriageDeleteR53, OldIP: "10.0.0.3"},
+		{Name: "d.example.org", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.2.4"},
+		// mappings naming a zone, by suffix or ID
+		{Name: "e.corp.example.com", Zone: "Corp.Example.com.", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.1.5"},
+		{Name: "f.example.com", Zone: "Z2", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.0.0.6"},
+	}
+
+	err := applyErr(provider.ApplyChanges(context.Background(), logging.Discard(), changes))
+	assert.IsType(t, &model.BatchError{}, err)
+	assert.Equal(t, []string{"Z1", "Z2"}, sender.zones)
+	assert.Equal(t, 4, len(sender.batches[0]))
+	assert.Equal(t, "c.example.com", aws.StringValue(sender.batches[0][2].ResourceRecordSet.Name))
+	assert.Equal(t, 4, len(sender.batches[1]))
+	assert.Equal(t, "/change/C2", changes[4].ChangeID)
+	assert.Equal(t, "hostname is routed to zone Z1, not Z2", changes[5].Error)
+
+	assert.Equal(t, "/change/C1", changes[0].ChangeID)
+	assert.Equal(t, "/change/C2", changes[1].ChangeID)
+	assert.Equal(t, "/change/C1", changes[2].ChangeID)
+	assert.Equal(t, "no hosted zone for d.example.org", changes[3].Error)
+}
+
+// fakeZoneLookup - Route53 API serving ListHostedZonesByName in pages of
+// two zones, and GetHostedZone for the VPC associations
+type fakeZoneLookup struct {
+	route53iface.Route53API
+	zones []*route53.HostedZone
+	vpcs  map[string][]string
+}
+
+func lookupZone(id, name string, private bool) *route53.HostedZone {
+	return &route53.HostedZone{
+		Id:     aws.String("/hostedzone/" + id),
+		Name:   aws.String(name),
+		Config: &route53.HostedZoneConfig{PrivateZone: aws.Bool(private)},
+	}
+}
+
+func (f *fakeZoneLookup) ListHostedZonesByNameWithContext(ctx aws.Context, input *route53.ListHostedZonesByNameInput, opts ...request.Option) (*route53.ListHostedZonesByNameOutput, error) {
+	start := len(f.zones)
+	for i, zone := range f.zones {
+		if aws.StringValue(zone.Name) >= aws.StringValue(input.DNSName) &&
+			(input.HostedZoneId == nil || aws.StringValue(zone.Id) == "/hostedzone/"+aws.StringValue(input.HostedZoneId)) {
+			start = i
+			break
+		}
+	}
+
+	end := start + 2
+	if end >= len(f.zones) {
+		return &route53.ListHostedZonesByNameOutput{HostedZones: f.zones[start:], IsTruncated: aws.Bool(false)}, nil
+	}
+
+	return &route53.ListHostedZonesByNameOutput{
+		HostedZones:      f.zones[start:end],
+		IsTruncated:      aws.Bool(true),
+		NextDNSName:      f.zones[end].Name,
+		NextHostedZoneId: aws.String(strings.TrimPrefix(aws.StringValue(f.zones[end].Id), "/hostedzone/")),
+	}, nil
+}
+
+func (f *fakeZoneLookup) GetHostedZoneWithContext(ctx aws.Context, input *route53.GetHostedZoneInput, opts ...request.Option) (*route53.GetHostedZoneOutput, error) {
+	output := &route53.GetHostedZoneOutput{}
+	for _, vpcID := range f.vpcs[aws.StringValue(input.Id)] {
+		output.VPCs = append(output.VPCs, &route53.VPC{VPCId: aws.String(vpcID), VPCRegion: aws.String("us-east-1")})
+	}
+	return output, nil
+}
+
+func TestDiscoverHostedZone(t *testing.T) {
+	lookup := &fakeZoneLookup{
+		zones: []*route53.HostedZone{
+			lookupZone("ZA", "a.example.com.", false),
+			lookupZone("ZPUB", "example.com.", false),
+			lookupZone("ZPRIV1", "example.com.", true),
+			lookupZone("ZPRIV2", "example.com.", true),
+			lookupZone("ZOTHER", "example.org.", false),
+		},
+		vpcs: map[string][]string{"ZPRIV1": {"vpc-1"}, "ZPRIV2": {"vpc-2", "vpc-3"}},
+	}
+
+	zoneID, err := discoverHostedZone(context.Background(), lookup, "Example.com", false, "")
+	assert.Nil(t, err)
+	assert.Equal(t, "ZPUB", zoneID)
+
+	zoneID, err = discoverHostedZone(context.Background(), lookup, "http://example.com.", true, "vpc-3")
+	assert.Nil(t, err)
+	assert.Equal(t, "ZPRIV2", zoneID)
+
+	_, err = discoverHostedZone(context.Background(), lookup, "example.com", true, "")
+	assert.Equal(t, "2 private hosted zones are named example.com.: ZPRIV1, ZPRIV2. Set R53_HOSTED_ZONE_ID to pick one",
+		err.Error())
+
+	_, err = discoverHostedZone(context.Background(), lookup, "example.com", true, "vpc-9")
+	assert.Equal(t, "no private (VPC vpc-9) hosted zone named example.com.", err.Error())
+
+	_, err = discoverHostedZone(context.Background(), lookup, "example.net", false, "")
+	assert.Equal(t, "no public hosted zone named example.net.", err.Error())
+}
+
+func TestHostedZoneVisibility(t *testing.T) {
+	assert.False(t, isPrivateHostedZone())
+
+	os.Setenv("R53_HOSTED_ZONE_PRIVATE", "true")
+	assert.True(t, isPrivateHostedZone())
+	os.Unsetenv("R53_HOSTED_ZONE_PRIVATE")
+
+	os.Setenv("R53_HOSTED_ZONE_VPC_ID", "vpc-1")
+	defer os.Unsetenv("R53_HOSTED_ZONE_VPC_ID")
+	assert.True(t, isPrivateHostedZone())
+}
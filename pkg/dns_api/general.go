@@ -22,6 +22,35 @@ func GetSyncFrequencySeconds() time.Duration {
 	return time.Duration(frequencyInt)
 }
 
+// GetHTTPListenAddress - address for the metrics and probe endpoints
+func GetHTTPListenAddress() string {
+	address := GetEnv("HTTP_LISTEN_ADDRESS")
+
+	if address == "" {
+		return ":8080"
+	}
+
+	return address
+}
+
+// GetLivenessMultiplier - liveness fails once no cycle completed within
+// this many sync frequencies
+func GetLivenessMultiplier() time.Duration {
+	multiplier := GetEnv("HEALTH_LIVENESS_MULTIPLIER")
+
+	if multiplier == "" {
+		return 3
+	}
+
+	multiplierInt, err := strconv.Atoi(multiplier)
+
+	if err != nil || multiplierInt < 1 {
+		return 3
+	}
+
+	return time.Duration(multiplierInt)
+}
+
 func GetEnv(name string) string {
 	if val, exist := os.LookupEnv(name); exist {
 		return val
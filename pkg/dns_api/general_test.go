@@ -21,3 +21,22 @@ func TestSyncFrequency(t *testing.T) {
 	os.Setenv("DNS_SYNC_FREQUENCY", "invalid")
 	assert.Equal(t, GetSyncFrequencySeconds(), time.Duration(600))
 }
+
+func TestLivenessMultiplier(t *testing.T) {
+	assert.Equal(t, GetLivenessMultiplier(), time.Duration(3))
+
+	os.Setenv("HEALTH_LIVENESS_MULTIPLIER", "5")
+	defer os.Unsetenv("HEALTH_LIVENESS_MULTIPLIER")
+	assert.Equal(t, GetLivenessMultiplier(), time.Duration(5))
+
+	os.Setenv("HEALTH_LIVENESS_MULTIPLIER", "0")
+	assert.Equal(t, GetLivenessMultiplier(), time.Duration(3))
+}
+
+func TestHTTPListenAddress(t *testing.T) {
+	assert.Equal(t, GetHTTPListenAddress(), ":8080")
+
+	os.Setenv("HTTP_LISTEN_ADDRESS", "127.0.0.1:9102")
+	defer os.Unsetenv("HTTP_LISTEN_ADDRESS")
+	assert.Equal(t, GetHTTPListenAddress(), "127.0.0.1:9102")
+}
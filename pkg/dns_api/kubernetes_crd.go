@@ -0,0 +1,280 @@
+package dns_api
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+
+	"github.com/pkg/errors"
+)
+
+// VmDnsRecord is the typed replacement for the vm-status configmaps.
+// See deploy/vmdnsrecord-crd.yaml for the schema. The configmaps are
+// still read during migration; a VmDnsRecord wins if both name the
+// same hostname.
+var vmDnsRecordResource = schema.GroupVersionResource{
+	Group:    "vmcdnssync.io",
+	Version:  "v1alpha1",
+	Resource: "vmdnsrecords",
+}
+
+const vmDnsRecordSyncedCondition = "Synced"
+
+// GetDynamicClient - returns client used for the VmDnsRecord custom resources
+func GetDynamicClient() (dynamic.Interface, error) {
+	clusterConfig, err := GetClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	dynamicClient, err := dynamic.NewForConfig(clusterConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create a dynamic client: %v", err)
+	}
+	return dynamicClient, nil
+}
+
+// GetVmDnsRecordMappings - lists VmDnsRecords across all namespaces
+func GetVmDnsRecordMappings(ctx context.Context, logger *logging.Logger) ([]model.DNSMapping, error) {
+	dynamicClient, err := GetDynamicClient()
+	if err != nil {
+		return nil, errors.Wrap(err, "Error getting dynamic client.")
+	}
+
+	return getVmDnsRecordMappings(ctx, logger, dynamicClient)
+}
+
+func getVmDnsRecordMappings(ctx context.Context, logger *logging.Logger,
+	dynamicClient dynamic.Interface) ([]model.DNSMapping, error) {
+	logger.Info("Syncing VmDnsRecords")
+
+	records, err := dynamicClient.Resource(vmDnsRecordResource).Namespace("").List(ctx,
+		metav1.ListOptions{})
+
+	// a cluster without the CRD is a supported setup, not a broken connection.
+	// Missing RBAC access is not: the records exist and would be treated as gone
+	if apierrors.IsNotFound(err) {
+		logger.Warn("VmDnsRecord CRD not installed. Using configmaps only", logging.FieldError, err)
+		return nil, nil
+	}
+	health.SetComponent(health.ComponentKubernetes, err)
+	if err != nil {
+		return nil, errors.Wrap(err, "Error listing VmDnsRecords.")
+	}
+
+	var mappings []model.DNSMapping
+
+	for _, record := range records.Items {
+		recordName := fmt.Sprintf("%s/%s", record.GetNamespace(), record.GetName())
+		hostname, _, _ := unstructured.NestedString(record.Object, "spec", "hostname")
+		vmName, _, _ := unstructured.NestedString(record.Object, "spec", "vmName")
+		vmNames, _, _ := unstructured.NestedStringSlice(record.Object, "spec", "vmNames")
+		ttl, _, _ := unstructured.NestedInt64(record.Object, "spec", "ttl")
+		zone, _, _ := unstructured.NestedString(record.Object, "spec", "zone")
+
+		if vmName != "" {
+			vmNames = append([]string{vmName}, vmNames...)
+		}
+
+		if hostname == "" || len(vmNames) == 0 {
+			logger.Warn("VmDnsRecord is missing hostname or vmName. We will skip this", "vmdnsrecord", recordName)
+			continue
+		}
+
+		selector, err := getVmDnsRecordAddressSelector(record)
+		if err != nil {
+			logger.Warn("Address selection of VmDnsRecord is invalid. We will skip this", "vmdnsrecord", recordName,
+				logging.FieldError, err)
+			continue
+		}
+
+		mappings = append(mappings, model.DNSMapping{
+			HttpEntry: "http://" + getAWSAName(hostname),
+			VMNames:   vmNames,
+			TTL:       ttl,
+			Zone:      zone,
+			Source:    model.MappingSourceVmDnsRecord,
+			Namespace: record.GetNamespace(),
+			Name:      record.GetName(),
+			Selector:  selector,
+		})
+	}
+
+	logger.Info("Fetched VmDnsRecords", "count", len(mappings))
+	return mappings, nil
+}
+
+func getVmDnsRecordAddressSelector(record unstructured.Unstructured) (model.AddressSelector, error) {
+	// optional spec.addressSelection override of the global address selection
+	networks, _, _ := unstructured.NestedStringSlice(record.Object, "spec", "addressSelection", "networks")
+	allowCIDRs, _, _ := unstructured.NestedStringSlice(record.Object, "spec", "addressSelection", "allowCIDRs")
+	denyCIDRs, _, _ := unstructured.NestedStringSlice(record.Object, "spec", "addressSelection", "denyCIDRs")
+	nicIndex, found, _ := unstructured.NestedInt64(record.Object, "spec", "addressSelection", "nicIndex")
+	publishAll, allFound, _ := unstructured.NestedBool(record.Object, "spec", "addressSelection", "publishAll")
+
+	var index, all string
+	if found {
+		index = strconv.FormatInt(nicIndex, 10)
+	}
+	if allFound {
+		all = strconv.FormatBool(publishAll)
+	}
+
+	return parseAddressSelector(networks, allowCIDRs, denyCIDRs, index, all)
+}
+
+// MergeVmDnsRecords - adds VmDnsRecords to the configmap based mapping.
+// VmDnsRecords take precedence for the same hostname. Several VmDnsRecords
+// for one hostname pool their VMs
+func MergeVmDnsRecords(logger *logging.Logger, dnsMap map[string]model.DNSMapping,
+	records []model.DNSMapping) map[string]model.DNSMapping {
+	fromRecords := make(map[string]bool)
+
+	for _, record := range records {
+		existing, ok := dnsMap[record.HttpEntry]
+
+		switch {
+		case ok && fromRecords[record.HttpEntry]:
+			logger.Info("VmDnsRecord adds VMs to a pool", "vmdnsrecord", record.Namespace+"/"+record.Name,
+				logging.FieldHostname, record.HttpEntry, logging.FieldVM, strings.Join(record.VMNames, ","))
+			existing.VMNames = append(existing.VMNames, record.VMNames...)
+			dnsMap[record.HttpEntry] = existing
+			continue
+		case ok:
+			logger.Info("Hostname is mapped by a configmap and a VmDnsRecord. Using the VmDnsRecord",
+				logging.FieldHostname, record.HttpEntry, "configmap_vms", strings.Join(existing.VMNames, ","),
+				"vmdnsrecord", record.Namespace+"/"+record.Name, logging.FieldVM, strings.Join(record.VMNames, ","))
+		}
+
+		// copy, so pooling never writes into the records slice
+		record.VMNames = append([]string(nil), record.VMNames...)
+		dnsMap[record.HttpEntry] = record
+		fromRecords[record.HttpEntry] = true
+	}
+
+	return dnsMap
+}
+
+// UpdateVmDnsRecordStatus - writes the outcome of a sync back to each VmDnsRecord.
+// Records missing from the triage result (e.g. outside a targeted sync) are left alone
+func UpdateVmDnsRecordStatus(ctx context.Context, logger *logging.Logger, records []model.DNSMapping,
+	triageResult map[string]model.IPTriageSummary, report model.SyncReport) {
+	if len(records) == 0 {
+		return
+	}
+
+	dynamicClient, err := GetDynamicClient()
+	if err != nil {
+		logger.Error("VmDnsRecord status not updated", logging.FieldError, err)
+		return
+	}
+
+	updateVmDnsRecordStatus(ctx, logger, dynamicClient, records, triageResult, report, time.Now())
+}
+
+func getVmDnsRecordSummary(triageResult map[string]model.IPTriageSummary, httpEntry string) (model.IPTriageSummary, bool) {
+	// a hostname has an A or an AAAA record, or both while the VM moves
+	// between them. Report the one that follows the VM
+	var found model.IPTriageSummary
+	var ok bool
+
+	for _, recordType := range []string{model.RecordTypeA, model.RecordTypeAAAA} {
+		summary, exists := triageResult[model.RecordKey(httpEntry, recordType)]
+		if !exists {
+			continue
+		}
+
+		if !ok || (found.VmwIP == "" && summary.VmwIP != "") {
+			found, ok = summary, true
+		}
+	}
+
+	return found, ok
+}
+
+func updateVmDnsRecordStatus(ctx context.Context, logger *logging.Logger, dynamicClient dynamic.Interface, records []model.DNSMapping,
+	triageResult map[string]model.IPTriageSummary, report model.SyncReport, now time.Time) {
+	for _, record := range records {
+		summary, ok := getVmDnsRecordSummary(triageResult, record.HttpEntry)
+		if !ok {
+			continue
+		}
+
+		client := dynamicClient.Resource(vmDnsRecordResource).Namespace(record.Namespace)
+		current, err := client.Get(ctx, record.Name, metav1.GetOptions{})
+		if err != nil {
+			logger.Warn("VmDnsRecord could not be read for status update", "vmdnsrecord", record.Namespace+"/"+record.Name,
+				logging.FieldError, err)
+			continue
+		}
+
+		setVmDnsRecordStatus(current, summary, report, now)
+
+		_, err = client.UpdateStatus(ctx, current, metav1.UpdateOptions{})
+		if err != nil {
+			logger.Warn("VmDnsRecord status update failed", "vmdnsrecord", record.Namespace+"/"+record.Name,
+				logging.FieldError, err)
+		}
+	}
+}
+
+func getVmDnsRecordCondition(summary model.IPTriageSummary, report model.SyncReport) (string, string, string) {
+	// returns status, reason and message of the Synced condition
+	switch {
+	case summary.VmwIP == "":
+		return "False", "VMNotFound", "VM was not found or has no IP"
+	case summary.SyncError != "":
+		return "False", "SyncFailed", summary.SyncError
+	case summary.Result == model.IPTriageNoChange:
+		return "True", "InSync", "Route53 record matches the VM IP"
+	case report.Refused:
+		return "False", "Refused", "Change not made - the delete guard refused the sync"
+	case report.DryRun:
+		return "False", "DryRun", "Change pending - dry run is enabled"
+	case summary.Propagation > 0:
+		return "True", "Updated", fmt.Sprintf("Route53 record updated and INSYNC after %v", summary.Propagation.Round(time.Second))
+	}
+
+	return "True", "Updated", "Route53 record updated"
+}
+
+func setVmDnsRecordStatus(record *unstructured.Unstructured, summary model.IPTriageSummary, report model.SyncReport, now time.Time) {
+	timestamp := now.UTC().Format(time.RFC3339)
+	status, reason, message := getVmDnsRecordCondition(summary, report)
+
+	transitionTime := timestamp
+	conditions, _, _ := unstructured.NestedSlice(record.Object, "status", "conditions")
+	for _, existing := range conditions {
+		condition, _ := existing.(map[string]interface{})
+		if condition["type"] == vmDnsRecordSyncedCondition && condition["status"] == status {
+			if previous, ok := condition["lastTransitionTime"].(string); ok {
+				transitionTime = previous
+			}
+		}
+	}
+
+	_ = unstructured.SetNestedField(record.Object, summary.VmwIP, "status", "ip")
+	_ = unstructured.SetNestedField(record.Object, timestamp, "status", "lastSyncTime")
+	if summary.ChangeID != "" {
+		_ = unstructured.SetNestedField(record.Object, strings.TrimPrefix(summary.ChangeID, "/change/"), "status", "changeID")
+	}
+	_ = unstructured.SetNestedSlice(record.Object, []interface{}{
+		map[string]interface{}{
+			"type":               vmDnsRecordSyncedCondition,
+			"status":             status,
+			"reason":             reason,
+			"message":            message,
+			"lastTransitionTime": transitionTime,
+		},
+	}, "status", "conditions")
+}
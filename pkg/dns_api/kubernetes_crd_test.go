@@ -0,0 +1,235 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func vmDnsRecord(name, hostname, vmName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "vmcdnssync.io/v1alpha1",
+			"kind":       "VmDnsRecord",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": "builds",
+			},
+			"spec": map[string]interface{}{
+				"hostname": hostname,
+				"vmName":   vmName,
+				"ttl":      int64(120),
+			},
+		},
+	}
+}
+
+func TestVmDnsRecordMappings(t *testing.T) {
+	zoned := vmDnsRecord("record-2", "host-2.example.com.", "builder-2")
+	unstructured.SetNestedField(zoned.Object, "example.com", "spec", "zone")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		vmDnsRecord("record-1", "host-1.example.com", "builder-1"),
+		zoned,
+		vmDnsRecord("record-3", "", "builder-3"),
+	)
+
+	mappings, err := getVmDnsRecordMappings(context.Background(), logging.Discard(), dynamicClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mappings))
+
+	byHost := make(map[string]model.DNSMapping)
+	for _, mapping := range mappings {
+		byHost[mapping.HttpEntry] = mapping
+	}
+	assert.Equal(t, []string{"builder-1"}, byHost["http://host-1.example.com"].VMNames)
+	assert.Equal(t, int64(120), byHost["http://host-1.example.com"].TTL)
+	assert.Equal(t, model.MappingSourceVmDnsRecord, byHost["http://host-1.example.com"].Source)
+	assert.Equal(t, "record-2", byHost["http://host-2.example.com"].Name)
+	assert.Equal(t, "example.com", byHost["http://host-2.example.com"].Zone)
+	assert.Equal(t, "", byHost["http://host-1.example.com"].Zone)
+
+	dnsMap := MergeVmDnsRecords(logging.Discard(), map[string]model.DNSMapping{
+		"http://host-1.example.com": {HttpEntry: "http://host-1.example.com", VMNames: []string{"legacy-builder"}},
+		"http://legacy.example.com": {HttpEntry: "http://legacy.example.com", VMNames: []string{"builder-9"}},
+	}, mappings)
+	assert.Equal(t, map[string]string{
+		"http://host-1.example.com": "builder-1",
+		"http://host-2.example.com": "builder-2",
+		"http://legacy.example.com": "builder-9",
+	}, vmNamesOf(dnsMap))
+	assert.Equal(t, model.MappingSourceVmDnsRecord, dnsMap["http://host-1.example.com"].Source)
+}
+
+func TestPooledMappings(t *testing.T) {
+	pooled := vmDnsRecord("record-1", "pool.example.com", "")
+	unstructured.SetNestedStringSlice(pooled.Object, []string{"builder-1", "builder-2"}, "spec", "vmNames")
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		pooled,
+		vmDnsRecord("record-2", "pool.example.com", "builder-3"),
+	)
+
+	mappings, err := getVmDnsRecordMappings(context.Background(), logging.Discard(), dynamicClient)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(mappings))
+
+	configmaps := []v1.ConfigMap{
+		*vmStatusConfigMap("cm-1", "http://pool.example.com", "legacy-builder", "deployed"),
+		*vmStatusConfigMap("cm-2", "http://cm-pool.example.com", "builder-4, builder-5", "deployed"),
+		*vmStatusConfigMap("cm-3", "http://cm-pool.example.com", "builder-6", "deployed"),
+	}
+	dnsMap := MergeVmDnsRecords(logging.Discard(), getDNSMapFromConfigmaps(logging.Discard(), configmaps), mappings)
+
+	assert.Equal(t, 2, len(dnsMap))
+	assert.ElementsMatch(t, []string{"builder-1", "builder-2", "builder-3"}, dnsMap["http://pool.example.com"].VMNames)
+	assert.Equal(t, []string{"builder-4", "builder-5", "builder-6"}, dnsMap["http://cm-pool.example.com"].VMNames)
+}
+
+func TestMissingVmDnsRecordCRD(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynamicClient.PrependReactor("list", "vmdnsrecords", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(vmDnsRecordResource.GroupResource(), "")
+	})
+	health.SetComponent(health.ComponentKubernetes, nil)
+
+	// clusters without the CRD use the configmaps alone, and stay ready
+	mappings, err := getVmDnsRecordMappings(context.Background(), logging.Discard(), dynamicClient)
+	assert.Nil(t, err)
+	assert.Nil(t, mappings)
+
+	recorder := httptest.NewRecorder()
+	health.ReadyzHandler()(recorder, httptest.NewRequest("GET", "/readyz", nil))
+	assert.False(t, strings.Contains(recorder.Body.String(), health.ComponentKubernetes))
+}
+
+func TestForbiddenVmDnsRecords(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+	dynamicClient.PrependReactor("list", "vmdnsrecords", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(vmDnsRecordResource.GroupResource(), "", nil)
+	})
+
+	// without RBAC access the records may exist, so this must not read as "no records"
+	mappings, err := getVmDnsRecordMappings(context.Background(), logging.Discard(), dynamicClient)
+	assert.NotNil(t, err)
+	assert.Nil(t, mappings)
+	health.SetComponent(health.ComponentKubernetes, nil)
+}
+
+func TestVmDnsRecordConditions(t *testing.T) {
+	status, reason, _ := getVmDnsRecordCondition(model.IPTriageSummary{}, model.SyncReport{})
+	assert.Equal(t, "False", status)
+	assert.Equal(t, "VMNotFound", reason)
+
+	status, reason, message := getVmDnsRecordCondition(model.IPTriageSummary{VmwIP: "10.0.0.1", SyncError: "throttled"}, model.SyncReport{})
+	assert.Equal(t, "False", status)
+	assert.Equal(t, "SyncFailed", reason)
+	assert.Equal(t, "throttled", message)
+
+	status, reason, _ = getVmDnsRecordCondition(model.IPTriageSummary{VmwIP: "10.0.0.1", Result: model.IPTriageNoChange}, model.SyncReport{DryRun: true})
+	assert.Equal(t, "True", status)
+	assert.Equal(t, "InSync", reason)
+
+	status, reason, _ = getVmDnsRecordCondition(model.IPTriageSummary{VmwIP: "10.0.0.1", Result: model.IPTriageAddR53}, model.SyncReport{DryRun: true})
+	assert.Equal(t, "False", status)
+	assert.Equal(t, "DryRun", reason)
+
+	status, reason, _ = getVmDnsRecordCondition(model.IPTriageSummary{VmwIP: "10.0.0.1", Result: model.IPTriageAddR53}, model.SyncReport{})
+	assert.Equal(t, "True", status)
+	assert.Equal(t, "Updated", reason)
+
+	// the delete guard stopped the change, so the record was not updated
+	status, reason, _ = getVmDnsRecordCondition(model.IPTriageSummary{VmwIP: "10.0.0.1", Result: model.IPTriageAddR53},
+		model.SyncReport{Refused: true})
+	assert.Equal(t, "False", status)
+	assert.Equal(t, "Refused", reason)
+
+	_, _, message = getVmDnsRecordCondition(model.IPTriageSummary{VmwIP: "10.0.0.1", Result: model.IPTriageAddR53,
+		Propagation: 41600 * time.Millisecond}, model.SyncReport{})
+	assert.Equal(t, "Route53 record updated and INSYNC after 42s", message)
+}
+
+func TestVmDnsRecordSummary(t *testing.T) {
+	triageResult := map[string]model.IPTriageSummary{
+		"http://v4":         {HttpEntry: "http://v4", VmwIP: "10.0.0.1"},
+		"http://moved":      {HttpEntry: "http://moved", R53IP: "10.0.0.2", Result: model.IPTriageDeleteR53},
+		"http://moved#AAAA": {HttpEntry: "http://moved", RecordType: "AAAA", VmwIP: "2001:db8::2", Result: model.IPTriageAddR53},
+	}
+
+	summary, ok := getVmDnsRecordSummary(triageResult, "http://v4")
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1", summary.VmwIP)
+
+	summary, ok = getVmDnsRecordSummary(triageResult, "http://moved")
+	assert.True(t, ok)
+	assert.Equal(t, "2001:db8::2", summary.VmwIP)
+
+	_, ok = getVmDnsRecordSummary(triageResult, "http://missing")
+	assert.False(t, ok)
+}
+
+func TestVmDnsRecordStatusWriteBack(t *testing.T) {
+	dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(),
+		vmDnsRecord("record-1", "host-1.example.com", "builder-1"),
+		vmDnsRecord("record-2", "host-2.example.com", "builder-2"),
+	)
+	mappings, _ := getVmDnsRecordMappings(context.Background(), logging.Discard(), dynamicClient)
+
+	firstSync := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	triageResult := map[string]model.IPTriageSummary{
+		"http://host-1.example.com": {
+			HttpEntry: "http://host-1.example.com",
+			VmwIP:     "10.0.0.1",
+			Result:    model.IPTriageAddR53,
+			ChangeID:  "/change/C2ABC",
+		},
+	}
+	updateVmDnsRecordStatus(context.Background(), logging.Discard(), dynamicClient, mappings, triageResult, model.SyncReport{}, firstSync)
+
+	client := dynamicClient.Resource(vmDnsRecordResource).Namespace("builds")
+	record, err := client.Get(context.TODO(), "record-1", metav1.GetOptions{})
+	assert.Nil(t, err)
+
+	ip, _, _ := unstructured.NestedString(record.Object, "status", "ip")
+	changeID, _, _ := unstructured.NestedString(record.Object, "status", "changeID")
+	lastSync, _, _ := unstructured.NestedString(record.Object, "status", "lastSyncTime")
+	conditions, _, _ := unstructured.NestedSlice(record.Object, "status", "conditions")
+	assert.Equal(t, "10.0.0.1", ip)
+	assert.Equal(t, "C2ABC", changeID)
+	assert.Equal(t, "2021-01-01T10:00:00Z", lastSync)
+	assert.Equal(t, "Updated", conditions[0].(map[string]interface{})["reason"])
+
+	// a later in-sync cycle keeps the change id and transition time
+	triageResult["http://host-1.example.com"] = model.IPTriageSummary{
+		HttpEntry: "http://host-1.example.com",
+		VmwIP:     "10.0.0.1",
+		Result:    model.IPTriageNoChange,
+	}
+	updateVmDnsRecordStatus(context.Background(), logging.Discard(), dynamicClient, mappings, triageResult, model.SyncReport{}, firstSync.Add(time.Hour))
+
+	record, _ = client.Get(context.TODO(), "record-1", metav1.GetOptions{})
+	changeID, _, _ = unstructured.NestedString(record.Object, "status", "changeID")
+	lastSync, _, _ = unstructured.NestedString(record.Object, "status", "lastSyncTime")
+	conditions, _, _ = unstructured.NestedSlice(record.Object, "status", "conditions")
+	assert.Equal(t, "C2ABC", changeID)
+	assert.Equal(t, "2021-01-01T11:00:00Z", lastSync)
+	assert.Equal(t, "InSync", conditions[0].(map[string]interface{})["reason"])
+	assert.Equal(t, "2021-01-01T10:00:00Z", conditions[0].(map[string]interface{})["lastTransitionTime"])
+
+	// records outside the triage result are untouched
+	record, _ = client.Get(context.TODO(), "record-2", metav1.GetOptions{})
+	_, found, _ := unstructured.NestedMap(record.Object, "status")
+	assert.False(t, found)
+}
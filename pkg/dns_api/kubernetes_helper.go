@@ -4,7 +4,13 @@ import (
 	"flag"
 	"fmt"
 	"context"
-	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
 
 	v1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
@@ -16,6 +22,9 @@ import (
 	"k8s.io/client-go/tools/clientcmd"
 )
 
+// only configmaps with this label are considered
+const vmStatusLabelSelector = "kind=vm-status"
+
 // Builds the configuration for the kubernetes client.
 // It first tries to read it from CLUSTER_KUBECONFIG env variable.
 // If the var is empty, then it will read it from the cluster.
@@ -23,13 +32,13 @@ func GetClusterConfig() (*rest.Config, error) {
 	var clusterConfig *rest.Config
 	var err error
 	if GetEnv("CLUSTER_KUBECONFIG") == "" {
-		fmt.Println("Using incluster kubeconfig")
+		logging.Debug("Using incluster kubeconfig")
 		clusterConfig, err = rest.InClusterConfig()
 		if err != nil {
 			return nil, errors.Wrap(err, "Error getting cluster config.")
 		}
 	} else {
-		fmt.Printf("Using kubeconfig from %s\n", GetEnv("CLUSTER_KUBECONFIG"))
+		logging.Debug("Using kubeconfig from CLUSTER_KUBECONFIG", "path", GetEnv("CLUSTER_KUBECONFIG"))
 		kubeconfigFlag := flag.Lookup("kubeconfig")
 		if kubeconfigFlag == nil {
 			kubeConfig := GetEnv("CLUSTER_KUBECONFIG")
@@ -61,54 +70,139 @@ func GetKubernetesClient() (kubernetes.Interface, error) {
 }
 
 // GetConfigmaps - lists configmaps we are interested in
-func getConfigmaps() ([]v1.ConfigMap, error) {
-	kubeClient, err := GetKubernetesClient()
-	if err != nil {
-		return nil, errors.Wrap(err, "Error getting kubernetes client.")
-	}
-
-	configMaps, err := kubeClient.CoreV1().ConfigMaps("").List(context.TODO(),
+func getConfigmaps(ctx context.Context, kubeClient kubernetes.Interface) ([]v1.ConfigMap, error) {
+	configMaps, err := kubeClient.CoreV1().ConfigMaps("").List(ctx,
 			metav1.ListOptions{
-				 LabelSelector: "kind=vm-status",
+				 LabelSelector: vmStatusLabelSelector,
 			},
 		)
+	if err != nil {
+		return nil, err
+	}
 
 	return configMaps.Items, nil
 }
 
+// GetDNStoVMMapping - hostname to VM mappings of the vm-status configmaps.
+// An error when they cannot all be listed, as a partial mapping would delete
+// the records of the configmaps left out
+func GetDNStoVMMapping(ctx context.Context, logger *logging.Logger) (map[string]model.DNSMapping, error) {
+	kubeClient, err := GetKubernetesClient()
+	if err != nil {
+		health.SetComponent(health.ComponentKubernetes, err)
+		return nil, errors.Wrap(err, "Error getting kubernetes client.")
+	}
 
-func GetDNStoVMMapping() map[string]string {
-	dnsMap := make(map[string]string)
+	return getDNStoVMMapping(ctx, logger, kubeClient)
+}
 
-	log.Println("Syncing Kubernetes configmaps")
+func getDNStoVMMapping(ctx context.Context, logger *logging.Logger,
+	kubeClient kubernetes.Interface) (map[string]model.DNSMapping, error) {
+	logger.Info("Syncing Kubernetes configmaps")
 
-	configmaps, err := getConfigmaps()
+	configmaps, err := getConfigmaps(ctx, kubeClient)
+	health.SetComponent(health.ComponentKubernetes, err)
 
 	if err != nil {
-		log.Println("Configmap fetch was unsuccessful")
-		log.Println("This is an unrecoverable error. No point proceeding")
-		return dnsMap
+		logger.Error("Configmap fetch was unsuccessful. No point proceeding", logging.FieldError, err)
+		return nil, err
+	}
+
+	return getDNSMapFromConfigmaps(logger, configmaps), nil
+}
+
+func getConfigmapAddressSelector(cm v1.ConfigMap) (model.AddressSelector, error) {
+	// optional per-mapping override of the global address selection
+	return parseAddressSelector(
+		splitList(cm.Data["ADDRESS_NETWORKS"]),
+		splitList(cm.Data["ADDRESS_ALLOW_CIDRS"]),
+		splitList(cm.Data["ADDRESS_DENY_CIDRS"]),
+		strings.TrimSpace(cm.Data["ADDRESS_NIC_INDEX"]),
+		strings.TrimSpace(cm.Data["ADDRESS_PUBLISH_ALL"]))
+}
+
+func getConfigmapTTL(cm v1.ConfigMap) (int64, error) {
+	// optional per-mapping TTL. 0 leaves it to DNS_DEFAULT_TTL
+	ttl := strings.TrimSpace(cm.Data["TTL"])
+
+	if ttl == "" {
+		return 0, nil
 	}
 
-	log.Printf("Fetched %d configmaps\n", len(configmaps))
+	ttlInt, err := strconv.ParseInt(ttl, 10, 64)
+	if err != nil || ttlInt < 0 {
+		return 0, fmt.Errorf("invalid TTL %q", ttl)
+	}
+
+	return ttlInt, nil
+}
 
-	for _, cm := range configmaps {
+func getDNSMapFromConfigmaps(logger *logging.Logger, configmaps []v1.ConfigMap) map[string]model.DNSMapping {
+	dnsMap := make(map[string]model.DNSMapping)
+
+	logger.Info("Fetched configmaps", "count", len(configmaps))
+
+	// the informer cache lists in no particular order. Pools take their TTL and
+	// address selection from the first configmap, so make that one stable
+	sorted := append([]v1.ConfigMap(nil), configmaps...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Namespace != sorted[j].Namespace {
+			return sorted[i].Namespace < sorted[j].Namespace
+		}
+		return sorted[i].Name < sorted[j].Name
+	})
+
+	for _, cm := range sorted {
 		cmName := fmt.Sprintf("%s/%s", cm.ObjectMeta.Namespace, cm.Name)
-		log.Printf("%s\n", cmName)
+		cmLogger := logger.With("configmap", cmName)
 
 		if _, ok := cm.Data["VM_NAME"]; !ok {
-			log.Printf("VM_NAME was not present in cm %s. We will skip this\n", cmName)
+			cmLogger.Warn("VM_NAME was not present in configmap. We will skip this")
 			continue
 		}
 
 		if cm.Data["STATUS"] != "deployed" {
-			log.Printf("Status indicates '%s', not 'deployed' in %s. Let's skip",
-				cm.Data["status"], cmName)
+			cmLogger.Debug("Status is not 'deployed'. Let's skip", "status", cm.Data["STATUS"])
+			continue
+		}
+
+		selector, err := getConfigmapAddressSelector(cm)
+		if err != nil {
+			cmLogger.Warn("Address selection is invalid. We will skip this", logging.FieldError, err)
 			continue
 		}
 
-		dnsMap[cm.Data["URL"]] = cm.Data["VM_NAME"]
+		ttl, err := getConfigmapTTL(cm)
+		if err != nil {
+			cmLogger.Warn("TTL is invalid. We will skip this", logging.FieldError, err)
+			continue
+		}
+
+		vmNames := splitList(cm.Data["VM_NAME"])
+
+		// several configmaps with the same URL pool their VMs into one record set
+		if pooled, ok := dnsMap[cm.Data["URL"]]; ok {
+			cmLogger.Info("Configmap adds VMs to a pool", logging.FieldHostname, cm.Data["URL"],
+				logging.FieldVM, strings.Join(vmNames, ","))
+			if ttl != pooled.TTL || !reflect.DeepEqual(selector, pooled.Selector) {
+				cmLogger.Warn("TTL or address selection differs from the pool. Using the pool's",
+					logging.FieldHostname, cm.Data["URL"], "pool_configmap", pooled.Namespace+"/"+pooled.Name)
+			}
+			pooled.VMNames = append(pooled.VMNames, vmNames...)
+			dnsMap[cm.Data["URL"]] = pooled
+			continue
+		}
+
+		dnsMap[cm.Data["URL"]] = model.DNSMapping{
+			HttpEntry: cm.Data["URL"],
+			VMNames:   vmNames,
+			TTL:       ttl,
+			Source:    model.MappingSourceConfigMap,
+			Namespace: cm.ObjectMeta.Namespace,
+			Name:      cm.Name,
+			Selector:  selector,
+		}
 	}
 
 	return dnsMap
-}
\ No newline at end of file
+}
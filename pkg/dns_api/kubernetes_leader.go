@@ -0,0 +1,207 @@
+package dns_api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"vmc-dns-sync/pkg/logging"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// Leader election lets several replicas run side by side. Only the
+// holder of the Lease reconciles; the others keep their watch caches
+// warm so they can take over straight away.
+
+const leaderLeaseDuration = 15 * time.Second
+const leaderRenewDeadline = 10 * time.Second
+const leaderRetryPeriod = 2 * time.Second
+
+// IsLeaderElectionEnabled - leader election is opt-in via LEADER_ELECTION=TRUE
+func IsLeaderElectionEnabled() bool {
+	return strings.ToUpper(GetEnv("LEADER_ELECTION")) == "TRUE"
+}
+
+func getLeaderElectionNamespace() string {
+	// use env var if present, else the pod namespace, else default
+	if namespace := GetEnv("LEADER_ELECTION_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+
+	if namespace := GetEnv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+
+	return "default"
+}
+
+func getLeaderElectionLeaseName() string {
+	leaseName := GetEnv("LEADER_ELECTION_LEASE_NAME")
+
+	if leaseName == "" {
+		return "vmc-dns-sync"
+	}
+
+	return leaseName
+}
+
+func getLeaderElectionIdentity() (string, error) {
+	// POD_NAME is expected via the downward API. Fall back to the hostname,
+	// which is the pod name anyway unless overridden
+	if podName := GetEnv("POD_NAME"); podName != "" {
+		return podName, nil
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", fmt.Errorf("leader election identity could not be determined: %v", err)
+	}
+
+	return hostname, nil
+}
+
+func newLeaderElectionConfig(kubeClient kubernetes.Interface, onStartedLeading func(ctx context.Context),
+	onStoppedLeading func()) (leaderelection.LeaderElectionConfig, error) {
+	identity, err := getLeaderElectionIdentity()
+	if err != nil {
+		return leaderelection.LeaderElectionConfig{}, err
+	}
+
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Namespace: getLeaderElectionNamespace(),
+			Name:      getLeaderElectionLeaseName(),
+		},
+		Client:    kubeClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+
+	return leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaderLeaseDuration,
+		RenewDeadline:   leaderRenewDeadline,
+		RetryPeriod:     leaderRetryPeriod,
+		ReleaseOnCancel: true,
+		Name:            getLeaderElectionLeaseName(),
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: onStartedLeading,
+			OnStoppedLeading: onStoppedLeading,
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					logging.Info("Another replica is the leader. Standing by as follower", "leader", leader)
+				}
+			},
+		},
+	}, nil
+}
+
+type leaseContextKey struct{}
+
+// getLeaseContext - the context of the Lease this cycle runs under, cancelled
+// as soon as the Lease is lost but not on shutdown. Without leader election
+// nothing can take over, so it never ends
+func getLeaseContext(ctx context.Context) context.Context {
+	if leaseCtx, ok := ctx.Value(leaseContextKey{}).(context.Context); ok {
+		return leaseCtx
+	}
+
+	return context.Background()
+}
+
+// RunLeaderElection blocks, calling onStartedLeading once this replica
+// holds the Lease. The context passed to it is cancelled when the Lease
+// is lost or ctx is done. This returns only after onStartedLeading did,
+// and on shutdown the Lease is released only then, so no other replica
+// starts syncing while a cycle is still running here
+func RunLeaderElection(ctx context.Context, onStartedLeading func(ctx context.Context), onStoppedLeading func()) error {
+	kubeClient, err := GetKubernetesClient()
+	if err != nil {
+		return err
+	}
+
+	return runLeaderElection(ctx, kubeClient, onStartedLeading, onStoppedLeading)
+}
+
+func runLeaderElection(ctx context.Context, kubeClient kubernetes.Interface, onStartedLeading func(ctx context.Context),
+	onStoppedLeading func()) error {
+	// the elector gets its own context. Cancelling it releases the Lease,
+	// which must wait for the sync loop rather than follow ctx right away
+	electionCtx, stopElection := context.WithCancel(context.Background())
+	defer stopElection()
+
+	var mu sync.Mutex
+	var leading, stopping bool
+	loopDone := make(chan struct{})
+
+	// waitForLoop - after this no sync loop is started, and any running one has returned
+	waitForLoop := func() {
+		mu.Lock()
+		stopping = true
+		wasLeading := leading
+		mu.Unlock()
+
+		if wasLeading {
+			<-loopDone
+		}
+	}
+
+	lec, err := newLeaderElectionConfig(kubeClient, func(leaderCtx context.Context) {
+		defer close(loopDone)
+
+		mu.Lock()
+		if stopping {
+			mu.Unlock()
+			return
+		}
+		leading = true
+		mu.Unlock()
+
+		loopCtx, cancel := context.WithCancel(leaderCtx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-loopCtx.Done():
+			}
+		}()
+
+		onStartedLeading(context.WithValue(loopCtx, leaseContextKey{}, leaderCtx))
+	}, onStoppedLeading)
+	if err != nil {
+		return err
+	}
+
+	elector, err := leaderelection.NewLeaderElector(lec)
+	if err != nil {
+		return err
+	}
+
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			waitForLoop()
+			stopElection()
+		case <-finished:
+		}
+	}()
+
+	logging.Info("Running leader election",
+		"lease", getLeaderElectionNamespace()+"/"+getLeaderElectionLeaseName(), "identity", lec.Lock.Identity())
+	elector.Run(electionCtx)
+
+	// a lost Lease also ends Run while the sync loop may still be finishing a cycle
+	waitForLoop()
+
+	return nil
+}
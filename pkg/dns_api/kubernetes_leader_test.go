@@ -0,0 +1,103 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/leaderelection"
+
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestLeaderElectionSettings(t *testing.T) {
+	assert.False(t, IsLeaderElectionEnabled())
+	assert.Equal(t, "default", getLeaderElectionNamespace())
+	assert.Equal(t, "vmc-dns-sync", getLeaderElectionLeaseName())
+
+	os.Setenv("LEADER_ELECTION", "true")
+	os.Setenv("POD_NAMESPACE", "dns")
+	os.Setenv("POD_NAME", "vmc-dns-sync-abc12")
+	defer os.Unsetenv("LEADER_ELECTION")
+	defer os.Unsetenv("POD_NAMESPACE")
+	defer os.Unsetenv("POD_NAME")
+
+	assert.True(t, IsLeaderElectionEnabled())
+	assert.Equal(t, "dns", getLeaderElectionNamespace())
+	identity, err := getLeaderElectionIdentity()
+	assert.Nil(t, err)
+	assert.Equal(t, "vmc-dns-sync-abc12", identity)
+
+	os.Setenv("LEADER_ELECTION_NAMESPACE", "kube-system")
+	defer os.Unsetenv("LEADER_ELECTION_NAMESPACE")
+	assert.Equal(t, "kube-system", getLeaderElectionNamespace())
+}
+
+func TestLeaderElectionAcquiresLease(t *testing.T) {
+	os.Setenv("POD_NAME", "replica-1")
+	defer os.Unsetenv("POD_NAME")
+
+	kubeClient := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	leading := make(chan struct{})
+	lec, err := newLeaderElectionConfig(kubeClient, func(ctx context.Context) {
+		close(leading)
+	}, func() {})
+	assert.Nil(t, err)
+
+	elector, err := leaderelection.NewLeaderElector(lec)
+	assert.Nil(t, err)
+	go elector.Run(ctx)
+
+	select {
+	case <-leading:
+	case <-time.After(10 * time.Second):
+		t.Fatal("lease was never acquired")
+	}
+
+	lease, err := kubeClient.CoordinationV1().Leases("default").Get(ctx, "vmc-dns-sync", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "replica-1", *lease.Spec.HolderIdentity)
+}
+
+func TestLeaderElectionWaitsForSyncLoop(t *testing.T) {
+	os.Setenv("POD_NAME", "replica-1")
+	defer os.Unsetenv("POD_NAME")
+
+	kubeClient := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var holder string
+	var loopReturned bool
+	leading := make(chan struct{})
+	go func() {
+		<-leading
+		cancel()
+	}()
+
+	err := runLeaderElection(ctx, kubeClient, func(leaderCtx context.Context) {
+		close(leading)
+		<-leaderCtx.Done()
+
+		// a cycle still finishing after the shutdown signal keeps the Lease
+		time.Sleep(100 * time.Millisecond)
+		lease, err := kubeClient.CoordinationV1().Leases("default").Get(context.Background(), "vmc-dns-sync",
+			metav1.GetOptions{})
+		assert.Nil(t, err)
+		holder = *lease.Spec.HolderIdentity
+		loopReturned = true
+	}, func() {})
+
+	assert.Nil(t, err)
+	assert.True(t, loopReturned)
+	assert.Equal(t, "replica-1", holder)
+
+	// released once the loop returned
+	lease, err := kubeClient.CoordinationV1().Leases("default").Get(context.Background(), "vmc-dns-sync", metav1.GetOptions{})
+	assert.Nil(t, err)
+	assert.Equal(t, "", *lease.Spec.HolderIdentity)
+}
@@ -0,0 +1,202 @@
+package dns_api
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+)
+
+// ConfigMapWatcher keeps a local informer cache of the vm-status
+// configmaps. Mapping lookups are served from the cache, and any
+// configmap that is added, changed or deleted queues its URL for
+// a targeted reconcile.
+type ConfigMapWatcher struct {
+	factory informers.SharedInformerFactory
+	lister  corelisters.ConfigMapLister
+	synced  cache.InformerSynced
+
+	mu      sync.Mutex
+	primed  bool
+	initial map[string]string
+	pending map[string]bool
+	notify  chan struct{}
+}
+
+// IsConfigMapWatchEnabled - the informer is on unless KUBERNETES_WATCH_MODE=FALSE
+func IsConfigMapWatchEnabled() bool {
+	return strings.ToUpper(GetEnv("KUBERNETES_WATCH_MODE")) != "FALSE"
+}
+
+// NewConfigMapWatcher builds the informer. Call Run to start it
+func NewConfigMapWatcher() (*ConfigMapWatcher, error) {
+	kubeClient, err := GetKubernetesClient()
+	if err != nil {
+		return nil, err
+	}
+
+	return newConfigMapWatcher(kubeClient), nil
+}
+
+func newConfigMapWatcher(kubeClient kubernetes.Interface) *ConfigMapWatcher {
+	factory := informers.NewSharedInformerFactoryWithOptions(kubeClient, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = vmStatusLabelSelector
+		}))
+	informer := factory.Core().V1().ConfigMaps()
+
+	w := &ConfigMapWatcher{
+		factory: factory,
+		lister:  informer.Lister(),
+		synced:  informer.Informer().HasSynced,
+		initial: make(map[string]string),
+		pending: make(map[string]bool),
+		notify:  make(chan struct{}, 1),
+	}
+
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			w.queue(nil, obj)
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			w.queue(oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			w.queue(obj, nil)
+		},
+	})
+
+	return w
+}
+
+// Run starts the informer and blocks until its cache is primed
+func (w *ConfigMapWatcher) Run(ctx context.Context) bool {
+	logging.Info("Starting configmap informer")
+	w.factory.Start(ctx.Done())
+
+	if !cache.WaitForCacheSync(ctx.Done(), w.synced) {
+		logging.Error("Configmap informer cache never synced")
+		return false
+	}
+
+	// handlers are delivered asynchronously, so the add events of the
+	// initial list can still trickle in. Remember what the cache held so
+	// those are not mistaken for new configmaps
+	cached, _ := w.lister.List(labels.Everything())
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	for _, cm := range cached {
+		w.initial[cm.Namespace+"/"+cm.Name] = cm.ResourceVersion
+	}
+	w.primed = true
+
+	logging.Info("Configmap informer cache synced")
+	health.SetComponent(health.ComponentKubernetes, nil)
+	return true
+}
+
+// Synced - true once the informer cache holds a full list
+func (w *ConfigMapWatcher) Synced() bool {
+	return w.synced()
+}
+
+// GetDNStoVMMapping serves the mapping from the informer cache, same shape as GetDNStoVMMapping()
+func (w *ConfigMapWatcher) GetDNStoVMMapping(logger *logging.Logger) (map[string]model.DNSMapping, error) {
+	logger.Info("Reading Kubernetes configmaps from informer cache")
+
+	cached, err := w.lister.List(labels.Everything())
+	if err != nil {
+		logger.Error("Configmap cache read failed", logging.FieldError, err)
+		return nil, err
+	}
+
+	configmaps := make([]v1.ConfigMap, 0, len(cached))
+	for _, cm := range cached {
+		configmaps = append(configmaps, *cm)
+	}
+
+	return getDNSMapFromConfigmaps(logger, configmaps), nil
+}
+
+// configmap keys read by getDNSMapFromConfigmaps. Edits to any other key do not change the mapping
+var mappingKeys = []string{"URL", "VM_NAME", "STATUS", "TTL", "ADDRESS_NETWORKS", "ADDRESS_ALLOW_CIDRS",
+	"ADDRESS_DENY_CIDRS", "ADDRESS_NIC_INDEX", "ADDRESS_PUBLISH_ALL"}
+
+func mappingChanged(oldCM, newCM *v1.ConfigMap) bool {
+	for _, key := range mappingKeys {
+		if oldCM.Data[key] != newCM.Data[key] {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (w *ConfigMapWatcher) queue(oldObj, newObj interface{}) {
+	oldCM, _ := oldObj.(*v1.ConfigMap)
+	newCM, _ := newObj.(*v1.ConfigMap)
+
+	if oldCM != nil && newCM != nil && !mappingChanged(oldCM, newCM) {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	// the initial list fills the cache and does not trigger reconciles
+	if !w.primed {
+		return
+	}
+	if oldCM == nil && newCM != nil {
+		if version, ok := w.initial[newCM.Namespace+"/"+newCM.Name]; ok && version == newCM.ResourceVersion {
+			return
+		}
+	}
+
+	for _, cm := range []*v1.ConfigMap{oldCM, newCM} {
+		if cm != nil && cm.Data["URL"] != "" {
+			logging.Info("Configmap changed. Queueing its hostname", "configmap", cm.Namespace+"/"+cm.Name,
+				logging.FieldHostname, cm.Data["URL"])
+			w.pending[cm.Data["URL"]] = true
+		}
+	}
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// Changed fires whenever at least one mapping changed since the last TakeChanged
+func (w *ConfigMapWatcher) Changed() <-chan struct{} {
+	return w.notify
+}
+
+// TakeChanged returns and clears the URLs of changed configmaps
+func (w *ConfigMapWatcher) TakeChanged() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var urls []string
+	for url := range w.pending {
+		urls = append(urls, url)
+	}
+	w.pending = make(map[string]bool)
+
+	return urls
+}
@@ -0,0 +1,145 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func vmStatusConfigMap(name, url, vmName, status string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: "builds",
+			Labels:    map[string]string{"kind": "vm-status"},
+		},
+		Data: map[string]string{
+			"URL":     url,
+			"VM_NAME": vmName,
+			"STATUS":  status,
+		},
+	}
+}
+
+func vmNamesOf(mappings map[string]model.DNSMapping) map[string]string {
+	vmNames := make(map[string]string)
+	for httpEntry, mapping := range mappings {
+		vmNames[httpEntry] = strings.Join(mapping.VMNames, ",")
+	}
+	return vmNames
+}
+
+func cachedMapping(t *testing.T, w *ConfigMapWatcher) map[string]model.DNSMapping {
+	dnsMap, err := w.GetDNStoVMMapping(logging.Discard())
+	assert.Nil(t, err)
+	return dnsMap
+}
+
+func waitForConfigMapChange(t *testing.T, w *ConfigMapWatcher, url string) {
+	// informer handlers run asynchronously, so keep draining until the URL shows up
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case <-w.Changed():
+			for _, changed := range w.TakeChanged() {
+				if changed == url {
+					return
+				}
+			}
+		case <-timeout:
+			t.Fatalf("change to %s was not noticed", url)
+		}
+	}
+}
+
+func TestConfigMapWatchFlag(t *testing.T) {
+	assert.True(t, IsConfigMapWatchEnabled())
+
+	os.Setenv("KUBERNETES_WATCH_MODE", "FALSE")
+	defer os.Unsetenv("KUBERNETES_WATCH_MODE")
+	assert.False(t, IsConfigMapWatchEnabled())
+}
+
+func TestConfigMapWatcher(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(
+		vmStatusConfigMap("cm-1", "http://host-1", "builder-1", "deployed"),
+		vmStatusConfigMap("cm-2", "http://host-2", "builder-2", "deploying"),
+	)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	w := newConfigMapWatcher(kubeClient)
+	assert.True(t, w.Run(ctx))
+	assert.True(t, w.Synced())
+	assert.Equal(t, map[string]string{"http://host-1": "builder-1"}, vmNamesOf(cachedMapping(t, w)))
+
+	configMaps := kubeClient.CoreV1().ConfigMaps("builds")
+	_, err := configMaps.Update(ctx, vmStatusConfigMap("cm-2", "http://host-2", "builder-2", "deployed"), metav1.UpdateOptions{})
+	assert.Nil(t, err)
+
+	waitForConfigMapChange(t, w, "http://host-2")
+	assert.Equal(t, []string{"builder-2"}, cachedMapping(t, w)["http://host-2"].VMNames)
+
+	err = configMaps.Delete(ctx, "cm-1", metav1.DeleteOptions{})
+	assert.Nil(t, err)
+
+	waitForConfigMapChange(t, w, "http://host-1")
+	assert.Equal(t, map[string]string{"http://host-2": "builder-2"}, vmNamesOf(cachedMapping(t, w)))
+
+	_, err = configMaps.Create(ctx, vmStatusConfigMap("cm-3", "http://host-3", "builder-3", "deployed"), metav1.CreateOptions{})
+	assert.Nil(t, err)
+
+	waitForConfigMapChange(t, w, "http://host-3")
+	assert.Equal(t, []string{"builder-3"}, cachedMapping(t, w)["http://host-3"].VMNames)
+}
+
+func TestConfigMapMappingChanged(t *testing.T) {
+	oldCM := vmStatusConfigMap("cm-1", "http://host-1", "builder-1", "deployed")
+	newCM := oldCM.DeepCopy()
+	newCM.Data["OWNER"] = "team-a"
+	assert.False(t, mappingChanged(oldCM, newCM))
+
+	newCM = oldCM.DeepCopy()
+	newCM.Data["ADDRESS_NETWORKS"] = "VM Network"
+	assert.True(t, mappingChanged(oldCM, newCM))
+
+	newCM = oldCM.DeepCopy()
+	newCM.Data["TTL"] = "60"
+	assert.True(t, mappingChanged(oldCM, newCM))
+
+	newCM = oldCM.DeepCopy()
+	newCM.Data["STATUS"] = "deploying"
+	assert.True(t, mappingChanged(oldCM, newCM))
+}
+
+func TestListedConfigMapMapping(t *testing.T) {
+	kubeClient := fake.NewSimpleClientset(
+		vmStatusConfigMap("cm-1", "http://host-1", "builder-1", "deployed"),
+	)
+
+	dnsMap, err := getDNStoVMMapping(context.Background(), logging.Discard(), kubeClient)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]string{"http://host-1": "builder-1"}, vmNamesOf(dnsMap))
+
+	// a failed list is an error, not an empty mapping that would delete every record
+	kubeClient.PrependReactor("list", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("forbidden")
+	})
+	dnsMap, err = getDNStoVMMapping(context.Background(), logging.Discard(), kubeClient)
+	assert.Equal(t, "forbidden", err.Error())
+	assert.Nil(t, dnsMap)
+}
@@ -0,0 +1,127 @@
+package dns_api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+)
+
+// DNSProvider is a DNS backend the triage engine syncs to. Implementations
+// only see provider-neutral records and changes, and log through the logger
+// of the cycle calling them
+type DNSProvider interface {
+	// Name - short provider name for logs
+	Name() string
+	// Zone - the zone records are written to. Saved plans are tied to it
+	Zone() string
+	// ListRecords - record sets owned by this sync, keyed by model.RecordKey.
+	// Names held by hand-made records or another owner are listed as Unowned
+	ListRecords(ctx context.Context, logger *logging.Logger) (map[string]model.DNSRecord, error)
+	// ApplyChanges - sends the changes, filling in ChangeID or Error on each,
+	// and counts the batches sent. Returns a *model.BatchError when any of them
+	// failed. Once ctx is cancelled no further batch is started, but one
+	// already sent is not cut off halfway
+	ApplyChanges(ctx context.Context, logger *logging.Logger, changes []model.DNSChange) (model.BatchCounts, error)
+}
+
+// errShutdown - error of the changes left unsent because the process is shutting down
+var errShutdown = errors.New("not sent: shutting down")
+
+func getDNSProviderName() string {
+	provider := strings.ToLower(GetEnv("DNS_PROVIDER"))
+
+	if provider == "" {
+		return "route53"
+	}
+
+	return provider
+}
+
+// GetDNSProvider - provider selected via env var DNS_PROVIDER: route53 (default) or rfc2136
+func GetDNSProvider(ctx context.Context) (DNSProvider, error) {
+	switch name := getDNSProviderName(); name {
+	case "route53":
+		return NewRoute53Provider(ctx)
+	case "rfc2136":
+		return NewRFC2136Provider()
+	default:
+		return nil, fmt.Errorf("unknown DNS provider %q", name)
+	}
+}
+
+// GetDefaultTTL - TTL of records whose mapping does not set one, via
+// DNS_DEFAULT_TTL. Defaults to 60 seconds
+func GetDefaultTTL() int64 {
+	ttl, err := strconv.ParseInt(GetEnv("DNS_DEFAULT_TTL"), 10, 64)
+
+	if err != nil || ttl < 0 {
+		return 60
+	}
+
+	return ttl
+}
+
+func isDNSLengthOK(httpEntry string) bool {
+	workName := getAWSAName(httpEntry)
+
+	entries := strings.Split(workName, ".")
+
+	return len(entries[0]) < 64
+}
+
+// GetDNSChanges - changes a triage result asks for. Entries no DNS server
+// would accept, and entries for names this sync does not own, are left out,
+// returned as skipped and marked with a SyncError
+func GetDNSChanges(logger *logging.Logger, triageInput map[string]model.IPTriageSummary) ([]model.DNSChange,
+	[]model.SkippedEntry) {
+	var changes []model.DNSChange
+	var skipped []model.SkippedEntry
+
+	for key, triage := range triageInput {
+		if triage.Result == model.IPTriageNoChange {
+			continue
+		}
+
+		var reason string
+		switch {
+		case triage.Unowned:
+			logger.Warn("Record exists and is not owned by this sync. Leaving it alone", logging.FieldHostname,
+				triage.HttpEntry, logging.FieldRecordType, triage.RecordType, "ip", triage.R53IP)
+			reason = "record exists and is not owned by this sync"
+		case !isDNSLengthOK(triage.HttpEntry):
+			logger.Warn("Hostname is too long. DNS will reject this - so let us skip it", logging.FieldHostname, triage.HttpEntry)
+			reason = "hostname label exceeds 63 characters"
+		}
+
+		if reason != "" {
+			triage.SyncError = reason
+			triageInput[key] = triage
+			skipped = append(skipped, model.SkippedEntry{Hostname: triage.HttpEntry,
+				Action: model.IPTriageResultName(triage.Result), Reason: triage.SyncError})
+			continue
+		}
+
+		recordType := triage.RecordType
+		if recordType == "" {
+			recordType = model.RecordTypeA
+		}
+
+		changes = append(changes, model.DNSChange{
+			Key:        key,
+			Name:       getAWSAName(triage.HttpEntry),
+			RecordType: recordType,
+			Zone:       triage.Zone,
+			Action:     triage.Result,
+			IP:         triage.VmwIP,
+			OldIP:      triage.R53IP,
+			TTL:        triage.VmwTTL,
+			OldTTL:     triage.R53TTL,
+		})
+	}
+
+	return changes, skipped
+}
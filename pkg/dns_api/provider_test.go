@@ -0,0 +1,95 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestDNSProviderSelection(t *testing.T) {
+	_, err := GetDNSProvider(context.Background())
+	assert.NotNil(t, err)
+
+	os.Setenv("R53_HOSTED_ZONE_ID", "ZTEST")
+	defer os.Unsetenv("R53_HOSTED_ZONE_ID")
+	provider, err := GetDNSProvider(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "route53", provider.Name())
+
+	os.Setenv("DNS_PROVIDER", "Route53")
+	defer os.Unsetenv("DNS_PROVIDER")
+	provider, err = GetDNSProvider(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "route53", provider.Name())
+
+	os.Setenv("DNS_PROVIDER", "carrier-pigeon")
+	_, err = GetDNSProvider(context.Background())
+	assert.NotNil(t, err)
+}
+
+func TestDNSChanges(t *testing.T) {
+	triageInput := map[string]model.IPTriageSummary{
+		"same":  {HttpEntry: "http://same.example.com", Result: model.IPTriageNoChange},
+		"moved": {HttpEntry: "http://moved.example.com.", VmwIP: "10.0.0.2", R53IP: "10.0.0.1", VmwTTL: 300, R53TTL: 60, Result: model.IPTriageUpdateR53},
+		"long":  {HttpEntry: "http://" + strings.Repeat("x", 64) + ".example.com", Result: model.IPTriageAddR53},
+	}
+
+	changes, skipped := GetDNSChanges(logging.Discard(), triageInput)
+
+	assert.Equal(t, []model.DNSChange{
+		{Key: "moved", Name: "moved.example.com", RecordType: "A", Action: model.IPTriageUpdateR53, IP: "10.0.0.2", OldIP: "10.0.0.1", TTL: 300, OldTTL: 60},
+	}, changes)
+	assert.Equal(t, "hostname label exceeds 63 characters", triageInput["long"].SyncError)
+	assert.Equal(t, []model.SkippedEntry{{Hostname: triageInput["long"].HttpEntry, Action: "add",
+		Reason: "hostname label exceeds 63 characters"}}, skipped)
+}
+
+func TestDefaultTTL(t *testing.T) {
+	assert.Equal(t, int64(60), GetDefaultTTL())
+
+	os.Setenv("DNS_DEFAULT_TTL", "300")
+	defer os.Unsetenv("DNS_DEFAULT_TTL")
+	assert.Equal(t, int64(300), GetDefaultTTL())
+
+	os.Setenv("DNS_DEFAULT_TTL", "-5")
+	assert.Equal(t, int64(60), GetDefaultTTL())
+
+	os.Setenv("DNS_DEFAULT_TTL", "five minutes")
+	assert.Equal(t, int64(60), GetDefaultTTL())
+}
+
+func TestPooledConfigmapsOrder(t *testing.T) {
+	first := vmStatusConfigMap("cm-a", "http://pool", "builder-1", "deployed")
+	first.Data["TTL"] = "300"
+	second := vmStatusConfigMap("cm-b", "http://pool", "builder-2", "deployed")
+	second.Data["TTL"] = "30"
+
+	// the pool follows cm-a whichever order the cache lists them in
+	for _, configmaps := range [][]v1.ConfigMap{{*first, *second}, {*second, *first}} {
+		pooled := getDNSMapFromConfigmaps(logging.Discard(), configmaps)["http://pool"]
+		assert.Equal(t, int64(300), pooled.TTL)
+		assert.Equal(t, "cm-a", pooled.Name)
+		assert.Equal(t, []string{"builder-1", "builder-2"}, pooled.VMNames)
+	}
+}
+
+func TestConfigmapTTL(t *testing.T) {
+	custom := vmStatusConfigMap("cm-1", "http://custom", "builder-1", "deployed")
+	custom.Data["TTL"] = "300"
+	broken := vmStatusConfigMap("cm-2", "http://broken", "builder-2", "deployed")
+	broken.Data["TTL"] = "soon"
+
+	dnsMap := getDNSMapFromConfigmaps(logging.Discard(), []v1.ConfigMap{
+		*custom, *broken, *vmStatusConfigMap("cm-3", "http://default", "builder-3", "deployed"),
+	})
+
+	assert.Equal(t, 2, len(dnsMap))
+	assert.Equal(t, int64(300), dnsMap["http://custom"].TTL)
+	assert.Equal(t, int64(0), dnsMap["http://default"].TTL)
+}
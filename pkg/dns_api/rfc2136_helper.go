@@ -0,0 +1,438 @@
+package dns_api
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"github.com/miekg/dns"
+)
+
+// RFC 2136 provider for BIND, Windows DNS and other servers that accept
+// dynamic updates. The zone is read with AXFR and changes are sent as
+// UPDATE messages, both signed with TSIG when a key is configured.
+// Ownership works as with Route53: every A and AAAA record is paired with a TXT record.
+
+const rfc2136Timeout = 10 * time.Second
+const rfc2136TsigFudge = 300
+
+// RFC2136Provider - DNSProvider backed by a server accepting RFC 2136 updates
+type RFC2136Provider struct {
+	server    string
+	zone      string
+	keyName   string
+	secret    string
+	algorithm string
+}
+
+func getRFC2136Server() string {
+	// host with optional port. Port defaults to 53
+	server := GetEnv("RFC2136_HOST")
+
+	if _, _, err := net.SplitHostPort(server); err != nil && server != "" {
+		return net.JoinHostPort(server, "53")
+	}
+
+	return server
+}
+
+func getRFC2136Algorithm() (string, error) {
+	switch algorithm := strings.ToLower(GetEnv("RFC2136_TSIG_ALGORITHM")); algorithm {
+	case "", "hmac-sha256":
+		return dns.HmacSHA256, nil
+	case "hmac-sha512":
+		return dns.HmacSHA512, nil
+	case "hmac-sha1":
+		return dns.HmacSHA1, nil
+	case "hmac-md5":
+		return dns.HmacMD5, nil
+	default:
+		return "", fmt.Errorf("unsupported TSIG algorithm %q", algorithm)
+	}
+}
+
+func getRFC2136BatchSize() int {
+	// use default 25 if nothing is present, else use env var
+	batchSize, err := strconv.Atoi(GetEnv("RFC2136_UPDATE_BATCH_SIZE"))
+
+	if err != nil || batchSize < 1 {
+		return 25
+	}
+
+	return batchSize
+}
+
+// NewRFC2136Provider - provider configured via RFC2136_HOST, RFC2136_ZONE
+// and optionally RFC2136_TSIG_KEYNAME, RFC2136_TSIG_SECRET and RFC2136_TSIG_ALGORITHM
+func NewRFC2136Provider() (RFC2136Provider, error) {
+	var p RFC2136Provider
+
+	p.server = getRFC2136Server()
+	if p.server == "" {
+		return p, fmt.Errorf("DNS server was expected and not provided via env var RFC2136_HOST")
+	}
+
+	zone := GetEnv("RFC2136_ZONE")
+	if zone == "" {
+		return p, fmt.Errorf("zone was expected and not provided via env var RFC2136_ZONE")
+	}
+	p.zone = dns.Fqdn(strings.ToLower(zone))
+
+	keyName := GetEnv("RFC2136_TSIG_KEYNAME")
+	if keyName == "" {
+		logging.Warn("No TSIG key configured via RFC2136_TSIG_KEYNAME. Zone transfers and updates are sent unsigned")
+		return p, nil
+	}
+
+	algorithm, err := getRFC2136Algorithm()
+	if err != nil {
+		return p, err
+	}
+
+	p.keyName = dns.Fqdn(strings.ToLower(keyName))
+	p.secret = GetEnv("RFC2136_TSIG_SECRET")
+	p.algorithm = algorithm
+
+	return p, nil
+}
+
+// Name - provider name for logs
+func (p RFC2136Provider) Name() string {
+	return "rfc2136"
+}
+
+// Zone - zone the records are synced to
+func (p RFC2136Provider) Zone() string {
+	return p.zone
+}
+
+func (p RFC2136Provider) tsigSecret() map[string]string {
+	if p.keyName == "" {
+		return nil
+	}
+
+	return map[string]string{p.keyName: p.secret}
+}
+
+func (p RFC2136Provider) sign(m *dns.Msg) {
+	if p.keyName != "" {
+		m.SetTsig(p.keyName, p.algorithm, rfc2136TsigFudge, time.Now().Unix())
+	}
+}
+
+// dial opens a TCP connection to the server that is closed once ctx is done,
+// so a shutdown does not wait out rfc2136Timeout on a server that stopped answering.
+// stop must be called when the connection is no longer used
+func (p RFC2136Provider) dial(ctx context.Context) (conn *dns.Conn, stop func(), err error) {
+	dialer := &net.Dialer{Timeout: rfc2136Timeout}
+	netConn, err := dialer.DialContext(ctx, "tcp", p.server)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			netConn.Close()
+		case <-done:
+		}
+	}()
+
+	return &dns.Conn{Conn: netConn}, func() { close(done) }, nil
+}
+
+func (p RFC2136Provider) transferZone(ctx context.Context) ([]dns.RR, error) {
+	var records []dns.RR
+
+	conn, stop, err := p.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	// the transfer closes the connection once the zone is read
+	transfer := &dns.Transfer{
+		Conn:         conn,
+		ReadTimeout:  rfc2136Timeout,
+		WriteTimeout: rfc2136Timeout,
+		TsigSecret:   p.tsigSecret(),
+	}
+
+	m := new(dns.Msg)
+	m.SetAxfr(p.zone)
+	p.sign(m)
+
+	envelopes, err := transfer.In(m, p.server)
+	if err != nil {
+		conn.Close()
+		return nil, contextError(ctx, err)
+	}
+
+	for envelope := range envelopes {
+		if envelope.Error != nil {
+			return nil, contextError(ctx, envelope.Error)
+		}
+		records = append(records, envelope.RR...)
+	}
+
+	return records, nil
+}
+
+func contextError(ctx context.Context, err error) error {
+	// a connection closed on shutdown reports "use of closed network connection"
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+func getRFC2136OwnedNames(records []dns.RR) map[string]bool {
+	// same as getOwnedNames, for records read by zone transfer
+	owned := make(map[string]bool)
+	ownershipText := getOwnershipText()
+
+	for _, record := range records {
+		txt, ok := record.(*dns.TXT)
+		if !ok {
+			continue
+		}
+
+		recordName, recordType, ok := parseOwnershipRecordName(getAWSAName(strings.ToLower(txt.Hdr.Name)))
+		if !ok {
+			continue
+		}
+
+		key := model.RecordKey(recordName, recordType)
+		owned[key] = owned[key] || strings.Join(txt.Txt, "") == ownershipText
+	}
+
+	return owned
+}
+
+// ListRecords - A and AAAA record sets of the zone by record key
+func (p RFC2136Provider) ListRecords(ctx context.Context, logger *logging.Logger) (map[string]model.DNSRecord, error) {
+	logger = logger.With(logging.FieldZone, p.zone)
+	if err := ctx.Err(); err != nil {
+		return nil, fmt.Errorf("zone transfer of %s not started: %v", p.zone, err)
+	}
+
+	logger.Info("Transferring zone", "server", p.server)
+	records, err := p.transferZone(ctx)
+	health.SetComponent(health.ComponentDNS, err)
+
+	if err != nil {
+		return nil, fmt.Errorf("zone transfer of %s from %s failed: %v", p.zone, p.server, err)
+	}
+
+	recordIPs := make(map[string][]string)
+	recordTTLs := make(map[string]int64)
+	unowned := make(map[string]bool)
+	ownedNames := getRFC2136OwnedNames(records)
+	logger.Info("Found owned records", "count", countOwnedNames(ownedNames), "owner", getOwnerID())
+
+	for _, record := range records {
+		var recordType, httpIP string
+
+		switch typed := record.(type) {
+		case *dns.A:
+			recordType, httpIP = model.RecordTypeA, typed.A.String()
+		case *dns.AAAA:
+			recordType, httpIP = model.RecordTypeAAAA, typed.AAAA.String()
+		default:
+			continue
+		}
+
+		recordName := getAWSAName(strings.ToLower(record.Header().Name))
+		httpRoute := "http://" + recordName
+		key := model.RecordKey(httpRoute, recordType)
+
+		if !ownedNames[model.RecordKey(recordName, recordType)] {
+			logger.Debug("Found record not owned by us", logging.FieldRecordType, recordType,
+				logging.FieldHostname, recordName, "ip", httpIP)
+			unowned[key] = true
+		} else {
+			logger.Debug("Adding route to map", logging.FieldRecordType, recordType, logging.FieldHostname, httpRoute, "ip", httpIP)
+		}
+		recordIPs[key] = append(recordIPs[key], httpIP)
+		recordTTLs[key] = int64(record.Header().Ttl)
+	}
+
+	// a zone transfer lists every value of an RRset as its own record
+	dnsMap := make(map[string]model.DNSRecord)
+	for key, ips := range recordIPs {
+		dnsMap[key] = model.DNSRecord{IPs: model.JoinIPs(ips), TTL: recordTTLs[key], Unowned: unowned[key]}
+	}
+	addForeignClaims(dnsMap, ownedNames, func(string) bool { return true })
+
+	logger.Info("Processed zone records", "records", len(records))
+	return dnsMap, nil
+}
+
+func getRFC2136Records(name, recordType, ips string, ttl int64) []dns.RR {
+	var records []dns.RR
+
+	for _, ip := range model.SplitIPs(ips) {
+		records = append(records, getRFC2136Record(name, recordType, ip, ttl))
+	}
+
+	return records
+}
+
+func getRFC2136Record(name, recordType, ip string, ttl int64) dns.RR {
+	if recordType == model.RecordTypeAAAA {
+		return &dns.AAAA{
+			Hdr:  dns.RR_Header{Name: name, Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+			AAAA: net.ParseIP(ip),
+		}
+	}
+
+	return &dns.A{
+		Hdr: dns.RR_Header{Name: name, Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: uint32(ttl)},
+		A:   net.ParseIP(ip),
+	}
+}
+
+func getRFC2136OwnershipTXT(name, recordType string) *dns.TXT {
+	return &dns.TXT{
+		Hdr: dns.RR_Header{Name: dns.Fqdn(getOwnershipRecordName(name, recordType)), Rrtype: dns.TypeTXT,
+			Class: dns.ClassINET, Ttl: ownershipRecordTTL},
+		Txt: []string{getOwnershipText()},
+	}
+}
+
+func (p RFC2136Provider) getUpdateMessage(logger *logging.Logger, changes []model.DNSChange) *dns.Msg {
+	m := new(dns.Msg)
+	m.SetUpdate(p.zone)
+
+	for _, change := range changes {
+		name := dns.Fqdn(change.Name)
+
+		switch change.Action {
+		case model.IPTriageAddR53:
+			logger.Info("Queueing change", logging.FieldAction, "ADD", logging.FieldRecordType, change.RecordType,
+				logging.FieldHostname, change.Name, logging.FieldNewIP, change.IP, "ttl", change.TTL)
+			records := getRFC2136Records(name, change.RecordType, change.IP, change.TTL)
+			// like a Route53 CREATE, a record made since the zone was read fails the update
+			m.RRsetNotUsed(records[:1])
+			m.Insert(append(records, getRFC2136OwnershipTXT(change.Name, change.RecordType)))
+		case model.IPTriageUpdateR53:
+			logger.Info("Queueing change", logging.FieldAction, "UPDATE", logging.FieldRecordType, change.RecordType,
+				logging.FieldHostname, change.Name, logging.FieldOldIP, change.OldIP, logging.FieldNewIP, change.IP, "ttl", change.TTL)
+			records := getRFC2136Records(name, change.RecordType, change.IP, change.TTL)
+			// replace the whole RRset, like an UPSERT would. Only owned records are updated
+			m.RemoveRRset(records[:1])
+			m.Insert(append(records, getRFC2136OwnershipTXT(change.Name, change.RecordType)))
+		case model.IPTriageDeleteR53:
+			logger.Info("Queueing change", logging.FieldAction, "DELETE", logging.FieldRecordType, change.RecordType,
+				logging.FieldHostname, change.Name, logging.FieldOldIP, change.OldIP)
+			m.Remove(append(getRFC2136Records(name, change.RecordType, change.OldIP, change.OldTTL),
+				getRFC2136OwnershipTXT(change.Name, change.RecordType)))
+		}
+	}
+
+	p.sign(m)
+	return m
+}
+
+func (p RFC2136Provider) contains(name string) bool {
+	name = dns.Fqdn(strings.ToLower(name))
+	return name == p.zone || strings.HasSuffix(name, "."+p.zone)
+}
+
+func (p RFC2136Provider) sendUpdate(ctx context.Context, m *dns.Msg) error {
+	conn, stop, err := p.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer stop()
+	defer conn.Close()
+
+	client := &dns.Client{
+		Net:        "tcp",
+		Timeout:    rfc2136Timeout,
+		TsigSecret: p.tsigSecret(),
+	}
+
+	reply, _, err := client.ExchangeWithConn(m, conn)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	if reply.Rcode != dns.RcodeSuccess {
+		return fmt.Errorf("update refused by %s: %s", p.server, dns.RcodeToString[reply.Rcode])
+	}
+
+	return nil
+}
+
+// ApplyChanges - sends the changes as UPDATE messages of RFC2136_UPDATE_BATCH_SIZE changes each.
+// A change whose hostname is outside RFC2136_ZONE, or whose mapping names another zone, is not sent.
+// The server would answer NOTZONE and fail the whole set
+func (p RFC2136Provider) ApplyChanges(ctx context.Context, logger *logging.Logger,
+	changes []model.DNSChange) (model.BatchCounts, error) {
+	var batches model.BatchCounts
+	logger = logger.With(logging.FieldZone, p.zone)
+
+	var indexes []int
+	for i, change := range changes {
+		if change.Zone != "" && dns.Fqdn(strings.ToLower(change.Zone)) != p.zone {
+			logger.Warn("Mapping names another zone. Skipping", logging.FieldHostname, change.Name,
+				"mapping_zone", change.Zone)
+			changes[i].Error = fmt.Sprintf("hostname is synced to zone %s, not %s", p.zone, change.Zone)
+			continue
+		}
+		if !p.contains(change.Name) {
+			logger.Warn("Hostname is outside the zone. Skipping", logging.FieldHostname, change.Name)
+			changes[i].Error = fmt.Sprintf("hostname is not in zone %s", p.zone)
+			continue
+		}
+		indexes = append(indexes, i)
+	}
+	if len(indexes) == 0 {
+		return batches, model.NewBatchError(changes)
+	}
+	updatePairs := getBatchPairs(len(indexes), getRFC2136BatchSize())
+
+	for i, eachPair := range updatePairs {
+		// on shutdown leave the remaining sets for the next run to pick up
+		if ctx.Err() != nil {
+			logger.Warn("Shutting down. Not sending the remaining change sets", "sets", len(updatePairs) - i)
+			for _, index := range indexes[eachPair.start:] {
+				changes[index].Error = errShutdown.Error()
+			}
+			break
+		}
+
+		setLogger := logger.With("set", i + 1)
+		setLogger.Info("Sending change set", "start", eachPair.start, "end", eachPair.end - 1)
+		var batch []model.DNSChange
+		for _, index := range indexes[eachPair.start:eachPair.end] {
+			batch = append(batch, changes[index])
+		}
+
+		err := p.sendUpdate(ctx, p.getUpdateMessage(setLogger, batch))
+		batches.Attempted++
+		if err != nil {
+			setLogger.Error("Change set failed. Not panicking...", logging.FieldError, err)
+		} else {
+			batches.Succeeded++
+			setLogger.Info("Change set sent")
+		}
+
+		for _, index := range indexes[eachPair.start:eachPair.end] {
+			if err != nil {
+				changes[index].Error = err.Error()
+			}
+		}
+	}
+
+	return batches, model.NewBatchError(changes)
+}
@@ -0,0 +1,389 @@
+package dns_api
+
+import (
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"context"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTsigKey = "vmc-dns-sync."
+const testTsigSecret = "c2VjcmV0LWZvci10ZXN0cw=="
+
+// fakeDNSServer - in-process stand-in for BIND. Serves AXFR of one zone and
+// applies RFC 2136 updates to it. Unsigned or badly signed requests are refused,
+// as are updates whose "RRset does not exist" prerequisites do not hold
+type fakeDNSServer struct {
+	mu      sync.Mutex
+	zone    string
+	records []dns.RR
+	updates int
+}
+
+func (f *fakeDNSServer) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	reply := new(dns.Msg)
+	reply.SetReply(r)
+
+	if r.IsTsig() == nil || w.TsigStatus() != nil {
+		reply.Rcode = dns.RcodeRefused
+		w.WriteMsg(reply)
+		return
+	}
+	reply.SetTsig(testTsigKey, dns.HmacSHA256, 300, time.Now().Unix())
+
+	switch {
+	case r.Opcode == dns.OpcodeUpdate:
+		f.updates++
+		if f.rrsetsUnused(r.Answer) {
+			f.applyUpdate(r.Ns)
+		} else {
+			reply.Rcode = dns.RcodeYXRrset
+		}
+	case r.Question[0].Qtype == dns.TypeAXFR:
+		soa, _ := dns.NewRR(f.zone + " 300 IN SOA ns." + f.zone + " admin." + f.zone + " 1 7200 900 1209600 300")
+		reply.Answer = append(append([]dns.RR{soa}, f.records...), soa)
+	default:
+		reply.Rcode = dns.RcodeNotImplemented
+	}
+
+	w.WriteMsg(reply)
+}
+
+func (f *fakeDNSServer) applyUpdate(changes []dns.RR) {
+	for _, change := range changes {
+		header := change.Header()
+
+		switch header.Class {
+		case dns.ClassANY:
+			f.remove(func(rr dns.RR) bool {
+				return rr.Header().Name == header.Name && rr.Header().Rrtype == header.Rrtype
+			})
+		case dns.ClassNONE:
+			f.remove(func(rr dns.RR) bool {
+				return rr.Header().Name == header.Name && rr.Header().Rrtype == header.Rrtype &&
+					strings.Join(strings.Fields(rr.String())[4:], " ") == strings.Join(strings.Fields(change.String())[4:], " ")
+			})
+		default:
+			f.records = append(f.records, change)
+		}
+	}
+}
+
+func (f *fakeDNSServer) rrsetsUnused(prerequisites []dns.RR) bool {
+	for _, prerequisite := range prerequisites {
+		for _, rr := range f.records {
+			if rr.Header().Name == prerequisite.Header().Name && rr.Header().Rrtype == prerequisite.Header().Rrtype {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+func (f *fakeDNSServer) remove(match func(rr dns.RR) bool) {
+	var kept []dns.RR
+	for _, rr := range f.records {
+		if !match(rr) {
+			kept = append(kept, rr)
+		}
+	}
+	f.records = kept
+}
+
+func (f *fakeDNSServer) updateCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.updates
+}
+
+func (f *fakeDNSServer) names(rrtype uint16) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	names := make(map[string]string)
+	for _, rr := range f.records {
+		if rr.Header().Rrtype == rrtype {
+			fields := strings.Fields(rr.String())
+			names[rr.Header().Name] = strings.Join(fields[4:], " ")
+		}
+	}
+
+	return names
+}
+
+func startFakeDNSServer(t *testing.T, fake *fakeDNSServer) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	started := make(chan struct{})
+	server := &dns.Server{
+		Listener:          listener,
+		Handler:           fake,
+		TsigSecret:        map[string]string{testTsigKey: testTsigSecret},
+		MsgAcceptFunc:     func(dh dns.Header) dns.MsgAcceptAction { return dns.MsgAccept },
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+
+	os.Setenv("RFC2136_HOST", listener.Addr().String())
+	os.Setenv("RFC2136_ZONE", strings.TrimSuffix(fake.zone, "."))
+	os.Setenv("RFC2136_TSIG_KEYNAME", testTsigKey)
+	os.Setenv("RFC2136_TSIG_SECRET", testTsigSecret)
+	t.Cleanup(func() {
+		os.Unsetenv("RFC2136_HOST")
+		os.Unsetenv("RFC2136_ZONE")
+		os.Unsetenv("RFC2136_TSIG_KEYNAME")
+		os.Unsetenv("RFC2136_TSIG_SECRET")
+	})
+}
+
+func mustRR(t *testing.T, s string) dns.RR {
+	rr, err := dns.NewRR(s)
+	assert.Nil(t, err)
+	return rr
+}
+
+func TestRFC2136Settings(t *testing.T) {
+	_, err := NewRFC2136Provider()
+	assert.NotNil(t, err)
+
+	os.Setenv("RFC2136_HOST", "10.0.0.53")
+	os.Setenv("RFC2136_ZONE", "Example.com")
+	defer os.Unsetenv("RFC2136_HOST")
+	defer os.Unsetenv("RFC2136_ZONE")
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.0.53:53", p.server)
+	assert.Equal(t, "example.com.", p.Zone())
+
+	os.Setenv("RFC2136_TSIG_KEYNAME", "key")
+	os.Setenv("RFC2136_TSIG_ALGORITHM", "hmac-sha3")
+	defer os.Unsetenv("RFC2136_TSIG_KEYNAME")
+	defer os.Unsetenv("RFC2136_TSIG_ALGORITHM")
+	_, err = NewRFC2136Provider()
+	assert.NotNil(t, err)
+
+	os.Setenv("RFC2136_TSIG_ALGORITHM", "HMAC-SHA512")
+	p, err = NewRFC2136Provider()
+	assert.Nil(t, err)
+	assert.Equal(t, "key.", p.keyName)
+	assert.Equal(t, dns.HmacSHA512, p.algorithm)
+}
+
+func TestRFC2136ListAndApply(t *testing.T) {
+	fake := &fakeDNSServer{zone: "example.com."}
+	fake.records = []dns.RR{
+		mustRR(t, "hand-made.example.com. 300 IN A 10.1.0.1"),
+		mustRR(t, "owned.example.com. 60 IN A 10.1.0.2"),
+		mustRR(t, "_vmc-dns-sync.owned.example.com. 300 IN TXT \"heritage=vmc-dns-sync,owner=vmc-dns-sync\""),
+		mustRR(t, "gone.example.com. 60 IN A 10.1.0.3"),
+		mustRR(t, "_vmc-dns-sync.gone.example.com. 300 IN TXT \"heritage=vmc-dns-sync,owner=vmc-dns-sync\""),
+		mustRR(t, "v6.example.com. 60 IN AAAA 2001:db8::6"),
+		mustRR(t, "_vmc-dns-sync-aaaa.v6.example.com. 300 IN TXT \"heritage=vmc-dns-sync,owner=vmc-dns-sync\""),
+	}
+	startFakeDNSServer(t, fake)
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+
+	dnsMap, err := p.ListRecords(context.Background(), logging.Discard())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]model.DNSRecord{
+		"http://hand-made.example.com": {IPs: "10.1.0.1", TTL: 300, Unowned: true},
+		"http://owned.example.com":     {IPs: "10.1.0.2", TTL: 60},
+		"http://gone.example.com":      {IPs: "10.1.0.3", TTL: 60},
+		"http://v6.example.com#AAAA":   {IPs: "2001:db8::6", TTL: 60},
+	}, dnsMap)
+
+	changes := []model.DNSChange{
+		{Name: "owned.example.com", RecordType: "A", Action: model.IPTriageUpdateR53, IP: "10.1.1.2", OldIP: "10.1.0.2", TTL: 60},
+		{Name: "gone.example.com", RecordType: "A", Action: model.IPTriageDeleteR53, OldIP: "10.1.0.3"},
+		{Name: "new.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.4", TTL: 300},
+		{Name: "v6.example.com", RecordType: "AAAA", Action: model.IPTriageUpdateR53, IP: "2001:db8::7", OldIP: "2001:db8::6", TTL: 60},
+	}
+	assert.Nil(t, applyErr(p.ApplyChanges(context.Background(), logging.Discard(), changes)))
+	assert.Equal(t, 1, fake.updateCount())
+
+	assert.Equal(t, map[string]string{
+		"hand-made.example.com.": "10.1.0.1",
+		"owned.example.com.":     "10.1.1.2",
+		"new.example.com.":       "10.1.0.4",
+	}, fake.names(dns.TypeA))
+	assert.Equal(t, map[string]string{"v6.example.com.": "2001:db8::7"}, fake.names(dns.TypeAAAA))
+	assert.Equal(t, 3, len(fake.names(dns.TypeTXT)))
+
+	dnsMap, err = p.ListRecords(context.Background(), logging.Discard())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]model.DNSRecord{
+		"http://hand-made.example.com": {IPs: "10.1.0.1", TTL: 300, Unowned: true},
+		"http://owned.example.com":     {IPs: "10.1.1.2", TTL: 60},
+		"http://new.example.com":       {IPs: "10.1.0.4", TTL: 300},
+		"http://v6.example.com#AAAA":   {IPs: "2001:db8::7", TTL: 60},
+	}, dnsMap)
+}
+
+func TestRFC2136NeverTakesOverRecords(t *testing.T) {
+	fake := &fakeDNSServer{zone: "example.com."}
+	fake.records = []dns.RR{
+		mustRR(t, "hand-made.example.com. 300 IN A 10.1.0.1"),
+		mustRR(t, "theirs.example.com. 60 IN A 10.1.0.2"),
+		mustRR(t, "_vmc-dns-sync.theirs.example.com. 300 IN TXT \"heritage=vmc-dns-sync,owner=site-b\""),
+		mustRR(t, "_vmc-dns-sync.claimed.example.com. 300 IN TXT \"heritage=vmc-dns-sync,owner=site-b\""),
+	}
+	startFakeDNSServer(t, fake)
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+
+	dnsMap, err := p.ListRecords(context.Background(), logging.Discard())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]model.DNSRecord{
+		"http://hand-made.example.com": {IPs: "10.1.0.1", TTL: 300, Unowned: true},
+		"http://theirs.example.com":    {IPs: "10.1.0.2", TTL: 60, Unowned: true},
+		"http://claimed.example.com":   {Unowned: true},
+	}, dnsMap)
+
+	// an add for a name that got a record since the zone was read is refused
+	changes := []model.DNSChange{
+		{Name: "hand-made.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.4", TTL: 60},
+	}
+	err = applyErr(p.ApplyChanges(context.Background(), logging.Discard(), changes))
+	assert.IsType(t, &model.BatchError{}, err)
+	assert.Equal(t, map[string]string{
+		"hand-made.example.com.": "10.1.0.1",
+		"theirs.example.com.":    "10.1.0.2",
+	}, fake.names(dns.TypeA))
+}
+
+func TestRFC2136MappingZone(t *testing.T) {
+	fake := &fakeDNSServer{zone: "example.com."}
+	startFakeDNSServer(t, fake)
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+
+	changes := []model.DNSChange{
+		{Name: "a.example.com", Zone: "Example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.1"},
+		{Name: "b.example.com", Zone: "example.org", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.2"},
+		{Name: "c.example.org", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.3"},
+	}
+	batches, err := p.ApplyChanges(context.Background(), logging.Discard(), changes)
+	assert.Equal(t, &model.BatchError{Failed: 2, Total: 3}, err)
+	assert.Equal(t, model.BatchCounts{Attempted: 1, Succeeded: 1}, batches)
+	assert.Equal(t, "", changes[0].Error)
+	assert.Equal(t, "hostname is synced to zone example.com., not example.org", changes[1].Error)
+	assert.Equal(t, "hostname is not in zone example.com.", changes[2].Error)
+	assert.Equal(t, map[string]string{"a.example.com.": "10.1.0.1"}, fake.names(dns.TypeA))
+}
+
+func TestRFC2136ShutdownStopsWaiting(t *testing.T) {
+	// a server that accepts connections and never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	os.Setenv("RFC2136_HOST", listener.Addr().String())
+	os.Setenv("RFC2136_ZONE", "example.com")
+	defer os.Unsetenv("RFC2136_HOST")
+	defer os.Unsetenv("RFC2136_ZONE")
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err = p.ListRecords(ctx, logging.Discard())
+	assert.NotNil(t, err)
+	assert.True(t, time.Since(start) < rfc2136Timeout/2)
+
+	ctx, cancel = context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	changes := []model.DNSChange{
+		{Name: "new.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.4"},
+	}
+	start = time.Now()
+	err = applyErr(p.ApplyChanges(ctx, logging.Discard(), changes))
+	assert.IsType(t, &model.BatchError{}, err)
+	assert.Equal(t, context.DeadlineExceeded.Error(), changes[0].Error)
+	assert.True(t, time.Since(start) < rfc2136Timeout/2)
+}
+
+func TestRFC2136RejectsBadKey(t *testing.T) {
+	fake := &fakeDNSServer{zone: "example.com."}
+	startFakeDNSServer(t, fake)
+	os.Setenv("RFC2136_TSIG_SECRET", "d3Jvbmcta2V5")
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+
+	_, err = p.ListRecords(context.Background(), logging.Discard())
+	assert.NotNil(t, err)
+
+	changes := []model.DNSChange{
+		{Name: "new.example.com", RecordType: "A", Action: model.IPTriageAddR53, IP: "10.1.0.4"},
+	}
+	err = applyErr(p.ApplyChanges(context.Background(), logging.Discard(), changes))
+	assert.IsType(t, &model.BatchError{}, err)
+	assert.NotEqual(t, "", changes[0].Error)
+	assert.Equal(t, 0, fake.updateCount())
+}
+
+func TestRFC2136MultiValue(t *testing.T) {
+	fake := &fakeDNSServer{zone: "example.com."}
+	fake.records = []dns.RR{
+		mustRR(t, "pool.example.com. 60 IN A 10.1.0.2"),
+		mustRR(t, "pool.example.com. 60 IN A 10.1.0.1"),
+		mustRR(t, "_vmc-dns-sync.pool.example.com. 300 IN TXT \"heritage=vmc-dns-sync,owner=vmc-dns-sync\""),
+	}
+	startFakeDNSServer(t, fake)
+
+	p, err := NewRFC2136Provider()
+	assert.Nil(t, err)
+
+	dnsMap, err := p.ListRecords(context.Background(), logging.Discard())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]model.DNSRecord{"http://pool.example.com": {IPs: "10.1.0.1,10.1.0.2", TTL: 60}}, dnsMap)
+
+	changes := []model.DNSChange{
+		{Name: "pool.example.com", RecordType: "A", Action: model.IPTriageUpdateR53,
+			IP: "10.1.0.2,10.1.0.3", OldIP: "10.1.0.1,10.1.0.2", TTL: 60},
+	}
+	assert.Nil(t, applyErr(p.ApplyChanges(context.Background(), logging.Discard(), changes)))
+
+	dnsMap, err = p.ListRecords(context.Background(), logging.Discard())
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]model.DNSRecord{"http://pool.example.com": {IPs: "10.1.0.2,10.1.0.3", TTL: 60}}, dnsMap)
+
+	changes = []model.DNSChange{
+		{Name: "pool.example.com", RecordType: "A", Action: model.IPTriageDeleteR53, OldIP: "10.1.0.2,10.1.0.3"},
+	}
+	assert.Nil(t, applyErr(p.ApplyChanges(context.Background(), logging.Discard(), changes)))
+	assert.Empty(t, fake.names(dns.TypeA))
+	assert.Empty(t, fake.names(dns.TypeTXT))
+}
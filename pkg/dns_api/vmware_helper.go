@@ -2,13 +2,17 @@ package dns_api
 
 import (
 	"context"
+	"fmt"
 	"github.com/vmware/govmomi"
 	"github.com/vmware/govmomi/view"
 	"github.com/vmware/govmomi/vim25/mo"
 	"github.com/vmware/govmomi/vim25/soap"
-	"log"
+	"github.com/vmware/govmomi/vim25/types"
 	"net/url"
 	"strings"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
 )
 
 func processOverride(u *url.URL) {
@@ -43,14 +47,13 @@ func processOverride(u *url.URL) {
 	}
 }
 
-// NewClient creates a govmomi.Client for use
-func NewClient(ctx context.Context) (*govmomi.Client, error) {
+// GetVCenterURL - VMWARE_SDDC_URL with the VMWARE_USERNAME and VMWARE_PASSWORD overrides applied
+func GetVCenterURL() (*url.URL, error) {
 	var urlFlag = GetEnv("VMWARE_SDDC_URL")
 
 	if urlFlag == "" {
-		log.Panic("Vmware SDDC URL expected via env var VMWARE_SDDC_URL is missing")
+		return nil, fmt.Errorf("Vmware SDDC URL expected via env var VMWARE_SDDC_URL is missing")
 	}
-	insecureConnect := strings.ToLower(GetEnv("VMWARE_VERIFY_SSL")) != "false"
 
 	// Parse URL from string
 	u, err := soap.ParseURL(urlFlag)
@@ -60,59 +63,87 @@ func NewClient(ctx context.Context) (*govmomi.Client, error) {
 
 	// Override username and/or password as required
 	processOverride(u)
+	return u, nil
+}
+
+// NewClient creates a govmomi.Client for use, logged in with a session keepalive
+func NewClient(ctx context.Context) (*govmomi.Client, error) {
+	u, err := GetVCenterURL()
+	if err != nil {
+		return nil, err
+	}
+	insecureConnect := strings.ToLower(GetEnv("VMWARE_VERIFY_SSL")) != "false"
 
 	// Connect and log in to ESX or vCenter
-	return govmomi.NewClient(ctx, u, insecureConnect)
+	return newKeepAliveClient(ctx, u, insecureConnect)
 }
 
-func GetVMs() (map[string]string, error) {
-	vmMap := make(map[string]string)
+func getGuestNICs(nics []types.GuestNicInfo) []model.GuestNIC {
+	var guestNICs []model.GuestNIC
 
-	log.Println("Initializing context")
-	ctx := context.TODO()
-
-	log.Println("Attempting to create vmware connection")
-	c, err := NewClient(ctx)
-	if err != nil {
-		log.Printf("Sorry - vmware connection attempt failed: %v\n", err)
-		return vmMap, err
+	for _, nic := range nics {
+		guestNICs = append(guestNICs, model.GuestNIC{
+			Network: nic.Network,
+			IPs:     nic.IpAddress,
+		})
 	}
-	log.Println("vmware connection succeeded. Now fetching VMs")
 
+	return guestNICs
+}
+
+func retrieveVMs(ctx context.Context, c *govmomi.Client, vms *[]mo.VirtualMachine) error {
 	m := view.NewManager(c.Client)
 	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder,
 		[]string{"VirtualMachine"}, true)
-
 	if err != nil {
-		log.Printf("Sorry - retrieval of VMs failed: %v\n", err)
-		return vmMap, err
+		return err
 	}
-	defer v.Destroy(ctx)
+	defer v.Destroy(context.Background())
 
-	// Retrieve summary property for all machines
+	// Retrieve summary and guest NICs for all machines
 	// Reference: http://pubs.vmware.com/vsphere-60/topic/com.vmware.wssdk.apiref.doc/vim.VirtualMachine.html
+	return v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"summary", "guest.net"}, vms)
+}
+
+// GetVMs - addresses of every VM that has one, keyed by VM name. The
+// session is kept logged in for the next call
+func GetVMs(ctx context.Context, logger *logging.Logger, vcenter *VCenterSession) (map[string]model.VMInfo, error) {
+	vmMap := make(map[string]model.VMInfo)
 	var vms []mo.VirtualMachine
-	err = v.Retrieve(ctx, []string{"VirtualMachine"}, []string{"summary"}, &vms)
+
+	err := vcenter.Do(ctx, logger, func(c *govmomi.Client) error {
+		logger.Info("vmware connection succeeded. Now fetching VMs")
+		vms = nil
+		return retrieveVMs(ctx, c, &vms)
+	})
+	health.SetComponent(health.ComponentVCenter, err)
 	if err != nil {
-		log.Printf("Sorry - retrieval of VMs failed: %v\n", err)
+		logger.Error("Sorry - retrieval of VMs failed", logging.FieldError, err)
 		return vmMap, err
 	}
 
 	for _, vm := range vms {
 		vmIP := vm.Summary.Guest.IpAddress
 		vmName := vm.Summary.Config.Name
+		var nics []model.GuestNIC
 
+		if vm.Guest != nil {
+			nics = getGuestNICs(vm.Guest.Net)
+		}
 
-		log.Printf("Fetched VM %s\n", vmName)
-
-		if vmIP == "" {
-			log.Printf("VM %s has no IP.It is either a frozen VM or a template. Let's skip\n", vmName)
+		if vmIP == "" && len(nics) == 0 {
+			logger.Debug("VM has no IP. It is either a frozen VM or a template. Let's skip", logging.FieldVM, vmName)
 			continue
 		}
 
-		log.Printf("Adding %s - %s\n", vmName, vmIP)
-		vmMap[vmName] = vmIP
+		logger.Debug("Adding VM", logging.FieldVM, vmName, "ip", vmIP, "nics", len(nics))
+		vmMap[vmName] = model.VMInfo{
+			Name:      vmName,
+			PrimaryIP: vmIP,
+			NICs:      nics,
+		}
 	}
 
+	logger.Info("Fetched VMs", "count", len(vms), "with_ip", len(vmMap))
 	return vmMap, nil
 }
\ No newline at end of file
@@ -0,0 +1,165 @@
+package dns_api
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+	"vmc-dns-sync/pkg/logging"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/session"
+	"github.com/vmware/govmomi/session/keepalive"
+	"github.com/vmware/govmomi/vim25"
+	"github.com/vmware/govmomi/vim25/soap"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// A vCenter session is logged in once and shared by every sync cycle and the
+// VM watch, instead of logging in per cycle. Shared VMC SDDCs limit the
+// sessions per user, so a keepalive stops the session from idling out
+// between cycles, a session vCenter dropped anyway is logged in again on
+// first use, and the session is logged out on shutdown
+
+// VCenterSession - vCenter client shared across cycles, logged in on first use
+type VCenterSession struct {
+	mu     sync.Mutex
+	client *govmomi.Client
+}
+
+// NewVCenterSession - session that connects to VMWARE_SDDC_URL when first used
+func NewVCenterSession() *VCenterSession {
+	return &VCenterSession{}
+}
+
+func getVCenterKeepAlive() time.Duration {
+	// use default 300 seconds if nothing valid is present, else use env var
+	seconds, err := strconv.Atoi(GetEnv("VMWARE_KEEPALIVE_SECONDS"))
+
+	if err != nil || seconds <= 0 {
+		return 300 * time.Second
+	}
+
+	return time.Duration(seconds) * time.Second
+}
+
+func isNotAuthenticated(err error) bool {
+	var fault interface{}
+
+	switch {
+	case soap.IsSoapFault(err):
+		fault = soap.ToSoapFault(err).VimFault()
+	case soap.IsVimFault(err):
+		fault = soap.ToVimFault(err)
+	default:
+		return false
+	}
+
+	switch fault.(type) {
+	case types.NotAuthenticated, *types.NotAuthenticated:
+		return true
+	}
+
+	return false
+}
+
+func (s *VCenterSession) getClient(ctx context.Context, logger *logging.Logger) (*govmomi.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+
+	logger.Debug("Attempting to create vmware connection")
+	c, err := NewClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Logged in to vmware")
+	s.client = c
+	return c, nil
+}
+
+func (s *VCenterSession) relogin(ctx context.Context, logger *logging.Logger, stale *govmomi.Client) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// another caller may have logged in again already
+	if s.client != stale {
+		return nil
+	}
+
+	logger.Warn("vmware session is no longer valid. Logging in again")
+	u, err := GetVCenterURL()
+	if err != nil {
+		return err
+	}
+
+	return stale.Login(ctx, u.User)
+}
+
+// Do - runs f with the logged-in client. When vCenter answers NotAuthenticated
+// the session is logged in again and f is run once more
+func (s *VCenterSession) Do(ctx context.Context, logger *logging.Logger, f func(c *govmomi.Client) error) error {
+	c, err := s.getClient(ctx, logger)
+	if err != nil {
+		return err
+	}
+
+	err = f(c)
+	if !isNotAuthenticated(err) {
+		return err
+	}
+
+	if err = s.relogin(ctx, logger, c); err != nil {
+		return err
+	}
+
+	return f(c)
+}
+
+// vCenter sessions are logged out even when the process is already shutting
+// down, so the logout gets a context of its own
+const vCenterLogoutTimeout = 10 * time.Second
+
+// Logout - ends the session, if there is one. Also stops the keepalive
+func (s *VCenterSession) Logout(logger *logging.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), vCenterLogoutTimeout)
+	defer cancel()
+
+	if err := s.client.Logout(ctx); err != nil {
+		logger.Warn("vmware logout failed", logging.FieldError, err)
+	} else {
+		logger.Info("Logged out of vmware")
+	}
+	s.client = nil
+}
+
+// newKeepAliveClient - logs in to u with a keepalive running for as long as
+// the session is logged in
+func newKeepAliveClient(ctx context.Context, u *url.URL, insecure bool) (*govmomi.Client, error) {
+	vimClient, err := vim25.NewClient(ctx, soap.NewClient(u, insecure))
+	if err != nil {
+		return nil, err
+	}
+
+	// the handler starts sending keepalives on Login and stops on Logout
+	vimClient.RoundTripper = keepalive.NewHandlerSOAP(vimClient.RoundTripper, getVCenterKeepAlive(), nil)
+	c := &govmomi.Client{Client: vimClient, SessionManager: session.NewManager(vimClient)}
+
+	if err = c.Login(ctx, u.User); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
@@ -0,0 +1,80 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/govmomi/simulator"
+	"vmc-dns-sync/pkg/logging"
+
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func startVCenterSimulator(t *testing.T) func() {
+	model := simulator.VPX()
+	if err := model.Create(); err != nil {
+		t.Fatal(err)
+	}
+	server := model.Service.NewServer()
+
+	os.Setenv("VMWARE_SDDC_URL", server.URL.String())
+	return func() {
+		os.Unsetenv("VMWARE_SDDC_URL")
+		server.Close()
+		model.Remove()
+	}
+}
+
+func TestVCenterKeepAlive(t *testing.T) {
+	assert.Equal(t, 300*time.Second, getVCenterKeepAlive())
+
+	os.Setenv("VMWARE_KEEPALIVE_SECONDS", "60")
+	defer os.Unsetenv("VMWARE_KEEPALIVE_SECONDS")
+	assert.Equal(t, 60*time.Second, getVCenterKeepAlive())
+}
+
+func TestVCenterSessionReuse(t *testing.T) {
+	defer startVCenterSimulator(t)()
+	ctx := context.Background()
+	vcenter := NewVCenterSession()
+
+	_, err := GetVMs(ctx, logging.Discard(), vcenter)
+	assert.Nil(t, err)
+	first := vcenter.client
+	userSession, _ := first.SessionManager.UserSession(ctx)
+	assert.NotNil(t, userSession)
+
+	// the next cycle keeps the session rather than logging in again
+	_, err = GetVMs(ctx, logging.Discard(), vcenter)
+	assert.Nil(t, err)
+	assert.True(t, first == vcenter.client)
+	again, _ := first.SessionManager.UserSession(ctx)
+	assert.Equal(t, userSession.Key, again.Key)
+
+	// a session vCenter dropped is logged in again
+	assert.Nil(t, first.SessionManager.Logout(ctx))
+	_, err = GetVMs(ctx, logging.Discard(), vcenter)
+	assert.Nil(t, err)
+	renewed, _ := first.SessionManager.UserSession(ctx)
+	assert.NotNil(t, renewed)
+	assert.NotEqual(t, userSession.Key, renewed.Key)
+
+	vcenter.Logout(logging.Discard())
+	assert.Nil(t, vcenter.client)
+	gone, _ := first.SessionManager.UserSession(ctx)
+	assert.Nil(t, gone)
+}
+
+func TestVCenterSessionWithoutURL(t *testing.T) {
+	ctx := context.Background()
+	vcenter := NewVCenterSession()
+
+	// a missing VMWARE_SDDC_URL fails the cycle, it does not take the daemon down
+	_, err := GetVMs(ctx, logging.Discard(), vcenter)
+	assert.NotNil(t, err)
+
+	defer startVCenterSimulator(t)()
+	_, err = GetVMs(ctx, logging.Discard(), vcenter)
+	assert.Nil(t, err)
+}
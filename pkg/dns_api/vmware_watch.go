@@ -0,0 +1,206 @@
+package dns_api
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+	"vmc-dns-sync/pkg/health"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+
+	"github.com/vmware/govmomi"
+	"github.com/vmware/govmomi/property"
+	"github.com/vmware/govmomi/view"
+	"github.com/vmware/govmomi/vim25/types"
+)
+
+// VMWatcher keeps a live VM address cache fed by the vCenter
+// property collector (WaitForUpdates), so IP changes are seen as
+// they happen instead of on the next full GetVMs poll.
+type VMWatcher struct {
+	vcenter *VCenterSession
+	mu      sync.Mutex
+	vms     map[types.ManagedObjectReference]model.VMInfo
+	synced  bool
+	pending map[string]bool
+	notify  chan struct{}
+}
+
+var vmWatchProperties = []string{"name", "guest.ipAddress", "guest.net"}
+
+const vmWatchRetrySeconds = 30
+
+// IsVMWatchEnabled - watch mode is opt-in via VMWARE_WATCH_MODE=TRUE
+func IsVMWatchEnabled() bool {
+	return strings.ToUpper(GetEnv("VMWARE_WATCH_MODE")) == "TRUE"
+}
+
+// NewVMWatcher creates an empty watcher on the shared session. Call Run to start filling it
+func NewVMWatcher(vcenter *VCenterSession) *VMWatcher {
+	return &VMWatcher{
+		vcenter: vcenter,
+		vms:     make(map[types.ManagedObjectReference]model.VMInfo),
+		pending: make(map[string]bool),
+		notify:  make(chan struct{}, 1),
+	}
+}
+
+// Run connects to vCenter and streams VM updates into the cache.
+// Connection failures are retried until the context is cancelled
+func (w *VMWatcher) Run(ctx context.Context) {
+	for {
+		err := w.watch(ctx)
+
+		if ctx.Err() != nil {
+			return
+		}
+
+		logging.Warn("VM watch stopped. Retrying", logging.FieldError, err, "retry_seconds", vmWatchRetrySeconds)
+		health.SetComponent(health.ComponentVCenter, err)
+		w.reset()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(vmWatchRetrySeconds * time.Second):
+		}
+	}
+}
+
+func (w *VMWatcher) watch(ctx context.Context) error {
+	return w.vcenter.Do(ctx, logging.Default(), func(c *govmomi.Client) error {
+		return w.watchVMs(ctx, c)
+	})
+}
+
+func (w *VMWatcher) watchVMs(ctx context.Context, c *govmomi.Client) error {
+	m := view.NewManager(c.Client)
+	v, err := m.CreateContainerView(ctx, c.ServiceContent.RootFolder,
+		[]string{"VirtualMachine"}, true)
+	if err != nil {
+		return err
+	}
+	defer v.Destroy(context.Background())
+
+	logging.Info("vmware connection succeeded. Watching VM IP changes")
+	health.SetComponent(health.ComponentVCenter, nil)
+	filter := new(property.WaitFilter).Add(v.Reference(), "VirtualMachine",
+		vmWatchProperties, v.TraversalSpec())
+
+	return property.WaitForUpdates(ctx, property.DefaultCollector(c.Client), filter,
+		func(updates []types.ObjectUpdate) bool {
+			w.applyUpdates(updates)
+			return false
+		})
+}
+
+func (w *VMWatcher) reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.vms = make(map[types.ManagedObjectReference]model.VMInfo)
+	w.synced = false
+}
+
+func (w *VMWatcher) applyUpdates(updates []types.ObjectUpdate) {
+	// The first update set after connecting carries every VM. It only
+	// fills the cache - after that, any IP change is queued for a reconcile
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	changed := 0
+
+	for _, update := range updates {
+		ref := update.Obj
+		oldVM := w.vms[ref]
+		newVM := oldVM
+
+		if update.Kind == types.ObjectUpdateKindLeave {
+			newVM = model.VMInfo{}
+			delete(w.vms, ref)
+		} else {
+			for _, change := range update.ChangeSet {
+				switch change.Name {
+				case "name":
+					newVM.Name, _ = change.Val.(string)
+				case "guest.ipAddress":
+					newVM.PrimaryIP, _ = change.Val.(string)
+				case "guest.net":
+					nics, _ := change.Val.(types.ArrayOfGuestNicInfo)
+					newVM.NICs = getGuestNICs(nics.GuestNicInfo)
+				}
+			}
+			w.vms[ref] = newVM
+		}
+
+		if !w.synced || reflect.DeepEqual(oldVM, newVM) {
+			continue
+		}
+
+		logging.Info("VM addresses changed", logging.FieldVM, newVM.Name,
+			logging.FieldOldIP, oldVM.PrimaryIP, logging.FieldNewIP, newVM.PrimaryIP)
+		for _, name := range []string{oldVM.Name, newVM.Name} {
+			if name != "" {
+				w.pending[name] = true
+			}
+		}
+		changed++
+	}
+
+	if !w.synced {
+		w.synced = true
+		logging.Info("VM watch cache primed", "count", len(w.vms))
+		return
+	}
+
+	if changed > 0 {
+		select {
+		case w.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Synced - true once the cache holds a full view of vCenter
+func (w *VMWatcher) Synced() bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.synced
+}
+
+// GetVMs returns the cached VM addresses, same shape as GetVMs()
+func (w *VMWatcher) GetVMs() map[string]model.VMInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	vmMap := make(map[string]model.VMInfo)
+	for _, vm := range w.vms {
+		if vm.Name != "" && (vm.PrimaryIP != "" || len(vm.NICs) > 0) {
+			vmMap[vm.Name] = vm
+		}
+	}
+
+	return vmMap
+}
+
+// Changed fires whenever the addresses of at least one VM changed since the last TakeChanged
+func (w *VMWatcher) Changed() <-chan struct{} {
+	return w.notify
+}
+
+// TakeChanged returns and clears the names of VMs with changed IPs
+func (w *VMWatcher) TakeChanged() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	var vmNames []string
+	for vmName := range w.pending {
+		vmNames = append(vmNames, vmName)
+	}
+	w.pending = make(map[string]bool)
+
+	return vmNames
+}
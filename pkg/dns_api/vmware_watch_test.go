@@ -0,0 +1,100 @@
+package dns_api
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/vmware/govmomi/vim25/types"
+	"vmc-dns-sync/pkg/model"
+
+	"os"
+	"testing"
+)
+
+func vmUpdate(kind types.ObjectUpdateKind, id, name, ip string) types.ObjectUpdate {
+	update := types.ObjectUpdate{
+		Kind: kind,
+		Obj:  types.ManagedObjectReference{Type: "VirtualMachine", Value: id},
+	}
+
+	if name != "" {
+		update.ChangeSet = append(update.ChangeSet, types.PropertyChange{Name: "name", Op: "assign", Val: name})
+	}
+	update.ChangeSet = append(update.ChangeSet, types.PropertyChange{Name: "guest.ipAddress", Op: "assign", Val: ip})
+
+	return update
+}
+
+func primaryIPsOf(vms map[string]model.VMInfo) map[string]string {
+	ips := make(map[string]string)
+	for name, vm := range vms {
+		ips[name] = vm.PrimaryIP
+	}
+	return ips
+}
+
+func TestWatchModeFlag(t *testing.T) {
+	assert.False(t, IsVMWatchEnabled())
+
+	os.Setenv("VMWARE_WATCH_MODE", "true")
+	defer os.Unsetenv("VMWARE_WATCH_MODE")
+	assert.True(t, IsVMWatchEnabled())
+}
+
+func TestVMWatcherUpdates(t *testing.T) {
+	w := NewVMWatcher(NewVCenterSession())
+	assert.False(t, w.Synced())
+
+	// initial full update set only primes the cache
+	w.applyUpdates([]types.ObjectUpdate{
+		vmUpdate(types.ObjectUpdateKindEnter, "vm-1", "builder-1", "10.0.0.1"),
+		vmUpdate(types.ObjectUpdateKindEnter, "vm-2", "builder-2", "10.0.0.2"),
+		vmUpdate(types.ObjectUpdateKindEnter, "vm-3", "template-1", ""),
+	})
+
+	assert.True(t, w.Synced())
+	assert.Equal(t, map[string]string{"builder-1": "10.0.0.1", "builder-2": "10.0.0.2"}, primaryIPsOf(w.GetVMs()))
+	assert.Empty(t, w.TakeChanged())
+	assert.Equal(t, 0, len(w.Changed()))
+
+	// an IP change (e.g. after vMotion) is queued for reconcile
+	w.applyUpdates([]types.ObjectUpdate{
+		vmUpdate(types.ObjectUpdateKindModify, "vm-1", "", "10.0.1.1"),
+	})
+	assert.Equal(t, 1, len(w.Changed()))
+	<-w.Changed()
+	assert.Equal(t, []string{"builder-1"}, w.TakeChanged())
+	assert.Equal(t, "10.0.1.1", w.GetVMs()["builder-1"].PrimaryIP)
+
+	// unchanged values do not trigger anything
+	w.applyUpdates([]types.ObjectUpdate{
+		vmUpdate(types.ObjectUpdateKindModify, "vm-2", "", "10.0.0.2"),
+	})
+	assert.Equal(t, 0, len(w.Changed()))
+
+	// so does a change on a secondary NIC
+	w.applyUpdates([]types.ObjectUpdate{{
+		Kind: types.ObjectUpdateKindModify,
+		Obj:  types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-1"},
+		ChangeSet: []types.PropertyChange{{Name: "guest.net", Op: "assign", Val: types.ArrayOfGuestNicInfo{
+			GuestNicInfo: []types.GuestNicInfo{
+				{Network: "mgmt", IpAddress: []string{"10.0.1.1"}},
+				{Network: "public", IpAddress: []string{"172.16.0.1", "2001:db8::1"}},
+			},
+		}}},
+	}})
+	assert.Equal(t, []string{"builder-1"}, w.TakeChanged())
+	assert.Equal(t, []model.GuestNIC{
+		{Network: "mgmt", IPs: []string{"10.0.1.1"}},
+		{Network: "public", IPs: []string{"172.16.0.1", "2001:db8::1"}},
+	}, w.GetVMs()["builder-1"].NICs)
+
+	// removed VMs drop out of the cache and are reconciled too
+	w.applyUpdates([]types.ObjectUpdate{
+		{Kind: types.ObjectUpdateKindLeave, Obj: types.ManagedObjectReference{Type: "VirtualMachine", Value: "vm-2"}},
+	})
+	assert.Equal(t, []string{"builder-2"}, w.TakeChanged())
+	assert.Equal(t, map[string]string{"builder-1": "10.0.1.1"}, primaryIPsOf(w.GetVMs()))
+
+	w.reset()
+	assert.False(t, w.Synced())
+	assert.Empty(t, w.GetVMs())
+}
@@ -0,0 +1,179 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Components whose connectivity decides readiness
+const (
+	ComponentVCenter    = "vcenter"
+	ComponentDNS        = "dns"
+	ComponentKubernetes = "kubernetes"
+)
+
+var requiredComponents = []string{ComponentVCenter, ComponentDNS, ComponentKubernetes}
+
+// Tracker holds the connection state of each component and the time
+// of the last completed reconcile cycle
+type Tracker struct {
+	mu         sync.Mutex
+	components map[string]error
+	tracking   bool
+	standby    bool
+	lastCycle  time.Time
+	now        func() time.Time
+}
+
+// NewTracker - every component starts out unknown, so not ready
+func NewTracker() *Tracker {
+	return &Tracker{
+		components: make(map[string]error),
+		now:        time.Now,
+	}
+}
+
+var defaultTracker = NewTracker()
+
+// SetComponent records the outcome of the last call to a component. nil means healthy
+func SetComponent(component string, err error) {
+	defaultTracker.SetComponent(component, err)
+}
+
+// StartCycleTracking - called when this replica starts reconciling
+func StartCycleTracking() {
+	defaultTracker.StartCycleTracking()
+}
+
+// StopCycleTracking - called when this replica stops reconciling (e.g. lost leadership)
+func StopCycleTracking() {
+	defaultTracker.StopCycleTracking()
+}
+
+// SetStandby - called while this replica waits for leadership. Components a
+// follower has not contacted do not count against readiness
+func SetStandby(standby bool) {
+	defaultTracker.SetStandby(standby)
+}
+
+// MarkCycleCompleted - called after every reconcile cycle, successful or not
+func MarkCycleCompleted() {
+	defaultTracker.MarkCycleCompleted()
+}
+
+// ReadyzHandler - 200 once vCenter, the DNS provider and Kubernetes were all reached successfully
+func ReadyzHandler() http.HandlerFunc {
+	return defaultTracker.ReadyzHandler()
+}
+
+// HealthzHandler - 503 if no cycle completed within maxCycleAge
+func HealthzHandler(maxCycleAge time.Duration) http.HandlerFunc {
+	return defaultTracker.HealthzHandler(maxCycleAge)
+}
+
+func (t *Tracker) SetComponent(component string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.components[component] = err
+}
+
+func (t *Tracker) StartCycleTracking() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// the clock starts now, so the first cycle gets the full allowance
+	t.tracking = true
+	t.lastCycle = t.now()
+}
+
+func (t *Tracker) StopCycleTracking() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.tracking = false
+}
+
+func (t *Tracker) SetStandby(standby bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.standby = standby
+}
+
+func (t *Tracker) MarkCycleCompleted() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.lastCycle = t.now()
+}
+
+func (t *Tracker) ready() (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var problems []string
+	for _, component := range requiredComponents {
+		err, reported := t.components[component]
+		switch {
+		case !reported && t.standby:
+			// followers only reach vCenter and the DNS provider once they lead
+		case !reported:
+			problems = append(problems, fmt.Sprintf("%s: not contacted yet", component))
+		case err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %v", component, err))
+		}
+	}
+	sort.Strings(problems)
+
+	if len(problems) > 0 {
+		return false, strings.Join(problems, "\n")
+	}
+
+	return true, "ok"
+}
+
+func (t *Tracker) alive(maxCycleAge time.Duration) (bool, string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	// followers do not reconcile, so there is nothing to be stuck on
+	if !t.tracking {
+		return true, "ok"
+	}
+
+	age := t.now().Sub(t.lastCycle)
+	if age > maxCycleAge {
+		return false, fmt.Sprintf("no sync cycle completed in %s (limit %s)", age.Round(time.Second), maxCycleAge)
+	}
+
+	return true, "ok"
+}
+
+func (t *Tracker) ReadyzHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, message := t.ready()
+		writeProbe(w, ok, message)
+	}
+}
+
+func (t *Tracker) HealthzHandler(maxCycleAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ok, message := t.alive(maxCycleAge)
+		writeProbe(w, ok, message)
+	}
+}
+
+func writeProbe(w http.ResponseWriter, ok bool, message string) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	fmt.Fprintln(w, message)
+}
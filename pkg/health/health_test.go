@@ -0,0 +1,88 @@
+package health
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func probe(handler func(w *httptest.ResponseRecorder)) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	handler(recorder)
+	return recorder
+}
+
+func TestReadiness(t *testing.T) {
+	tracker := NewTracker()
+	readyz := func(w *httptest.ResponseRecorder) {
+		tracker.ReadyzHandler()(w, httptest.NewRequest("GET", "/readyz", nil))
+	}
+
+	assert.Equal(t, 503, probe(readyz).Code)
+
+	tracker.SetComponent(ComponentVCenter, nil)
+	tracker.SetComponent(ComponentDNS, nil)
+	tracker.SetComponent(ComponentKubernetes, fmt.Errorf("connection refused"))
+
+	recorder := probe(readyz)
+	assert.Equal(t, 503, recorder.Code)
+	assert.Equal(t, "kubernetes: connection refused\n", recorder.Body.String())
+
+	tracker.SetComponent(ComponentKubernetes, nil)
+	assert.Equal(t, 200, probe(readyz).Code)
+}
+
+func TestFollowerReadiness(t *testing.T) {
+	tracker := NewTracker()
+	readyz := func(w *httptest.ResponseRecorder) {
+		tracker.ReadyzHandler()(w, httptest.NewRequest("GET", "/readyz", nil))
+	}
+
+	// a follower never reaches vCenter or the DNS provider
+	tracker.SetStandby(true)
+	assert.Equal(t, 200, probe(readyz).Code)
+
+	tracker.SetComponent(ComponentKubernetes, fmt.Errorf("connection refused"))
+	recorder := probe(readyz)
+	assert.Equal(t, 503, recorder.Code)
+	assert.Equal(t, "kubernetes: connection refused\n", recorder.Body.String())
+
+	// once leading, every component counts again
+	tracker.SetComponent(ComponentKubernetes, nil)
+	tracker.SetStandby(false)
+	recorder = probe(readyz)
+	assert.Equal(t, 503, recorder.Code)
+	assert.Equal(t, "dns: not contacted yet\nvcenter: not contacted yet\n", recorder.Body.String())
+}
+
+func TestLiveness(t *testing.T) {
+	clock := time.Date(2021, 1, 1, 10, 0, 0, 0, time.UTC)
+	tracker := NewTracker()
+	tracker.now = func() time.Time { return clock }
+
+	healthz := func(w *httptest.ResponseRecorder) {
+		tracker.HealthzHandler(30*time.Minute)(w, httptest.NewRequest("GET", "/healthz", nil))
+	}
+
+	// not reconciling (e.g. follower) is always alive
+	clock = clock.Add(time.Hour)
+	assert.Equal(t, 200, probe(healthz).Code)
+
+	tracker.StartCycleTracking()
+	clock = clock.Add(20 * time.Minute)
+	assert.Equal(t, 200, probe(healthz).Code)
+
+	// a cycle stuck past the allowance fails liveness
+	clock = clock.Add(20 * time.Minute)
+	assert.Equal(t, 503, probe(healthz).Code)
+
+	tracker.MarkCycleCompleted()
+	assert.Equal(t, 200, probe(healthz).Code)
+
+	clock = clock.Add(time.Hour)
+	tracker.StopCycleTracking()
+	assert.Equal(t, 200, probe(healthz).Code)
+}
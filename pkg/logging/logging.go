@@ -0,0 +1,265 @@
+package logging
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Field names shared by every line that is about a record, so the log
+// pipeline can filter on them
+const (
+	FieldCycle      = "cycle"
+	FieldHostname   = "hostname"
+	FieldVM         = "vm"
+	FieldOldIP      = "old_ip"
+	FieldNewIP      = "new_ip"
+	FieldAction     = "action"
+	FieldRecordType = "record_type"
+	FieldZone       = "zone"
+	FieldError      = "error"
+)
+
+// Level - severity of a line. Lines below the logger's level are dropped
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "unknown"
+	}
+
+	return levelNames[l]
+}
+
+// ParseLevel - level by name. Unknown names are info
+func ParseLevel(name string) Level {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(strings.TrimSpace(name), levelName) {
+			return Level(level)
+		}
+	}
+
+	return LevelInfo
+}
+
+type field struct {
+	key   string
+	value interface{}
+}
+
+// output - destination shared by a logger and the loggers derived from it,
+// so lines from several goroutines are never interleaved
+type output struct {
+	mu   sync.Mutex
+	w    io.Writer
+	json bool
+	now  func() time.Time
+}
+
+// Logger writes one line per call, as a JSON object or as text, with the
+// fields it carries followed by the ones given to the call
+type Logger struct {
+	out    *output
+	level  Level
+	fields []field
+}
+
+// New - logger writing JSON lines, or text lines when asJSON is false
+func New(w io.Writer, level Level, asJSON bool) *Logger {
+	return &Logger{
+		out:   &output{w: w, json: asJSON, now: time.Now},
+		level: level,
+	}
+}
+
+// Discard - logger that writes nothing
+func Discard() *Logger {
+	return New(ioutil.Discard, LevelError+1, true)
+}
+
+var defaultLogger = New(os.Stderr, ParseLevel(os.Getenv("LOG_LEVEL")),
+	strings.ToLower(os.Getenv("LOG_FORMAT")) != "text")
+
+// Default - logger configured by LOG_LEVEL (default info) and LOG_FORMAT
+// (json by default, text for reading by eye)
+func Default() *Logger {
+	return defaultLogger
+}
+
+// RedirectStdLog - sends lines written through the standard log package,
+// e.g. by libraries, to the default logger at info level
+func RedirectStdLog() {
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{defaultLogger})
+}
+
+type stdLogWriter struct {
+	logger *Logger
+}
+
+func (s stdLogWriter) Write(p []byte) (int, error) {
+	s.logger.Info(strings.TrimSpace(string(p)))
+	return len(p), nil
+}
+
+// NewCycleID - random ID tying together the lines of one sync cycle
+func NewCycleID() string {
+	id := make([]byte, 6)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+
+	return hex.EncodeToString(id)
+}
+
+// With - logger adding the key and value to every line
+func (l *Logger) With(key string, value interface{}) *Logger {
+	fields := make([]field, len(l.fields), len(l.fields)+1)
+	copy(fields, l.fields)
+
+	return &Logger{out: l.out, level: l.level, fields: append(fields, field{key, value})}
+}
+
+// Enabled - whether lines of the level are written
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+// Debug, Info, Warn and Error write msg with the logger's fields and the
+// given key-value pairs
+func (l *Logger) Debug(msg string, keyvals ...interface{}) {
+	l.write(LevelDebug, msg, keyvals)
+}
+
+func (l *Logger) Info(msg string, keyvals ...interface{}) {
+	l.write(LevelInfo, msg, keyvals)
+}
+
+func (l *Logger) Warn(msg string, keyvals ...interface{}) {
+	l.write(LevelWarn, msg, keyvals)
+}
+
+func (l *Logger) Error(msg string, keyvals ...interface{}) {
+	l.write(LevelError, msg, keyvals)
+}
+
+func (l *Logger) write(level Level, msg string, keyvals []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+
+	fields := append([]field(nil), l.fields...)
+	for i := 0; i < len(keyvals); i += 2 {
+		key := fmt.Sprint(keyvals[i])
+		if i+1 == len(keyvals) {
+			fields = append(fields, field{"extra", keyvals[i]})
+			break
+		}
+		fields = append(fields, field{key, keyvals[i+1]})
+	}
+
+	l.out.mu.Lock()
+	defer l.out.mu.Unlock()
+
+	timestamp := l.out.now().UTC().Format(time.RFC3339Nano)
+	if l.out.json {
+		l.out.w.Write(encodeJSON(timestamp, level, msg, fields))
+	} else {
+		l.out.w.Write(encodeText(timestamp, level, msg, fields))
+	}
+}
+
+func fieldValue(value interface{}) interface{} {
+	// errors and durations read better as their strings than as JSON values
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return value
+}
+
+func encodeJSON(timestamp string, level Level, msg string, fields []field) []byte {
+	var line bytes.Buffer
+
+	// keys are written in order, so lines stay easy to read as well
+	writePair := func(key string, value interface{}) {
+		encodedKey, _ := json.Marshal(key)
+		encodedValue, err := json.Marshal(fieldValue(value))
+		if err != nil {
+			encodedValue, _ = json.Marshal(fmt.Sprint(value))
+		}
+
+		if line.Len() > 1 {
+			line.WriteByte(',')
+		}
+		line.Write(encodedKey)
+		line.WriteByte(':')
+		line.Write(encodedValue)
+	}
+
+	line.WriteByte('{')
+	writePair("time", timestamp)
+	writePair("level", level.String())
+	writePair("msg", msg)
+	for _, f := range fields {
+		writePair(f.key, f.value)
+	}
+	line.WriteString("}\n")
+
+	return line.Bytes()
+}
+
+func encodeText(timestamp string, level Level, msg string, fields []field) []byte {
+	var line bytes.Buffer
+
+	fmt.Fprintf(&line, "%s %-5s %s", timestamp, strings.ToUpper(level.String()), msg)
+	for _, f := range fields {
+		value := fmt.Sprint(fieldValue(f.value))
+		if strings.ContainsAny(value, " \t\"=") || value == "" {
+			value = fmt.Sprintf("%q", value)
+		}
+		fmt.Fprintf(&line, " %s=%s", f.key, value)
+	}
+	line.WriteByte('\n')
+
+	return line.Bytes()
+}
+
+// Debug, Info, Warn and Error on the default logger, for code that does not
+// run as part of a sync cycle
+func Debug(msg string, keyvals ...interface{}) {
+	defaultLogger.Debug(msg, keyvals...)
+}
+
+func Info(msg string, keyvals ...interface{}) {
+	defaultLogger.Info(msg, keyvals...)
+}
+
+func Warn(msg string, keyvals ...interface{}) {
+	defaultLogger.Warn(msg, keyvals...)
+}
+
+func Error(msg string, keyvals ...interface{}) {
+	defaultLogger.Error(msg, keyvals...)
+}
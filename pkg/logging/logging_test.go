@@ -0,0 +1,79 @@
+package logging
+
+import (
+	"github.com/stretchr/testify/assert"
+
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fixedLogger(out *bytes.Buffer, level Level, asJSON bool) *Logger {
+	logger := New(out, level, asJSON)
+	logger.out.now = func() time.Time {
+		return time.Date(2021, 1, 2, 3, 4, 5, 0, time.UTC)
+	}
+
+	return logger
+}
+
+func TestJSONLines(t *testing.T) {
+	var out bytes.Buffer
+	logger := fixedLogger(&out, LevelInfo, true).With(FieldCycle, "c0ffee")
+
+	logger.With(FieldZone, "Z1").Info("Queueing change", FieldHostname, "a.example.com", FieldOldIP, "",
+		FieldNewIP, "10.0.0.1", "ttl", int64(60))
+	logger.Error("Change failed", FieldError, fmt.Errorf("throttled"), "delay", 1500*time.Millisecond)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, `{"time":"2021-01-02T03:04:05Z","level":"info","msg":"Queueing change","cycle":"c0ffee",`+
+		`"zone":"Z1","hostname":"a.example.com","old_ip":"","new_ip":"10.0.0.1","ttl":60}`, lines[0])
+
+	var fields map[string]interface{}
+	assert.Nil(t, json.Unmarshal([]byte(lines[1]), &fields))
+	assert.Equal(t, "error", fields["level"])
+	assert.Equal(t, "c0ffee", fields[FieldCycle])
+	assert.Equal(t, "throttled", fields[FieldError])
+	assert.Equal(t, "1.5s", fields["delay"])
+	assert.Nil(t, fields[FieldZone])
+}
+
+func TestLevels(t *testing.T) {
+	var out bytes.Buffer
+	logger := fixedLogger(&out, LevelWarn, false)
+
+	logger.Debug("dropped")
+	logger.Info("dropped")
+	logger.Warn("Change set failed. Retrying", "attempt", 1, "error_code", "Throttling", "note", "rate exceeded")
+	assert.Equal(t, "2021-01-02T03:04:05Z WARN  Change set failed. Retrying attempt=1 error_code=Throttling "+
+		"note=\"rate exceeded\"\n", out.String())
+
+	assert.Equal(t, LevelDebug, ParseLevel("DEBUG"))
+	assert.Equal(t, LevelError, ParseLevel(" error"))
+	assert.Equal(t, LevelInfo, ParseLevel("verbose"))
+
+	out.Reset()
+	Discard().Error("dropped")
+	assert.Empty(t, out.String())
+}
+
+func TestStdLogRedirect(t *testing.T) {
+	var out bytes.Buffer
+	previous := defaultLogger
+	defaultLogger = fixedLogger(&out, LevelInfo, true)
+	defer func() {
+		defaultLogger = previous
+	}()
+
+	RedirectStdLog()
+	log.Printf("from a library\n")
+
+	assert.Equal(t, `{"time":"2021-01-02T03:04:05Z","level":"info","msg":"from a library"}`+"\n", out.String())
+	assert.Equal(t, 12, len(NewCycleID()))
+	assert.NotEqual(t, NewCycleID(), NewCycleID())
+}
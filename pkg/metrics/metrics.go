@@ -0,0 +1,168 @@
+package metrics
+
+import (
+	"net/http"
+	"time"
+	"vmc-dns-sync/pkg/model"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "vmc_dns_sync"
+
+var (
+	vmsFetched = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "vms_fetched",
+		Help:      "VMs with an IP returned by vCenter in the last cycle",
+	})
+	mappedEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "mapped_entries",
+		Help:      "Hostname to VM mappings read from Kubernetes in the last cycle",
+	})
+	route53Records = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "route53_records",
+		Help:      "Owned Route53 records read in the last cycle",
+	})
+	triageResults = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "triage_results",
+		Help:      "Triage outcomes of the last cycle by result",
+	}, []string{"result"})
+	route53Batches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route53_batches_total",
+		Help:      "Route53 change batches submitted, by outcome and AWS error code",
+	}, []string{"outcome", "error_code"})
+	route53BatchRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "route53_batch_retries_total",
+		Help:      "Route53 change batches sent again after a retryable error, by AWS error code",
+	}, []string{"error_code"})
+	route53Propagation = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "route53_change_propagation_seconds",
+		Help:      "Time from sending a Route53 change batch to it reaching INSYNC, by outcome",
+		Buckets:   []float64{5, 10, 20, 30, 45, 60, 90, 120, 300},
+	}, []string{"outcome"})
+	changes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "changes_total",
+		Help:      "Record changes by action and outcome: applied, failed, dry_run, refused or skipped",
+	}, []string{"action", "outcome"})
+	cycles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cycles_total",
+		Help:      "Sync cycles run, by type (full or targeted) and outcome",
+	}, []string{"type", "outcome"})
+	cycleDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cycle_duration_seconds",
+		Help:      "Duration of sync cycles, by type (full or targeted)",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300},
+	}, []string{"type"})
+	lastCycleSuccess = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_successful_cycle_timestamp_seconds",
+		Help:      "Unix time of the last sync cycle that completed without error",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(vmsFetched, mappedEntries, route53Records, triageResults,
+		route53Batches, route53BatchRetries, route53Propagation, changes, cycles, cycleDuration, lastCycleSuccess)
+}
+
+// Handler - serves the /metrics endpoint
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveSources - sizes of the three inputs to triage
+func ObserveSources(vmCount, mappingCount, recordCount int) {
+	vmsFetched.Set(float64(vmCount))
+	mappedEntries.Set(float64(mappingCount))
+	route53Records.Set(float64(recordCount))
+}
+
+// ObserveTriage - outcome counts per model.IPTriage* result
+func ObserveTriage(triageResult map[string]model.IPTriageSummary) {
+	counts := map[string]int{
+		model.IPTriageResultName(model.IPTriageNoChange):  0,
+		model.IPTriageResultName(model.IPTriageDeleteR53): 0,
+		model.IPTriageResultName(model.IPTriageUpdateR53): 0,
+		model.IPTriageResultName(model.IPTriageAddR53):    0,
+	}
+
+	for _, summary := range triageResult {
+		counts[model.IPTriageResultName(summary.Result)]++
+	}
+
+	for result, count := range counts {
+		triageResults.WithLabelValues(result).Set(float64(count))
+	}
+}
+
+// ObserveBatch - one Route53 change batch. errorCode is empty on success
+func ObserveBatch(errorCode string) {
+	if errorCode == "" {
+		route53Batches.WithLabelValues("success", "").Inc()
+		return
+	}
+
+	route53Batches.WithLabelValues("failure", errorCode).Inc()
+}
+
+// ObserveBatchRetry - one retry of a Route53 change batch after a retryable error
+func ObserveBatchRetry(errorCode string) {
+	route53BatchRetries.WithLabelValues(errorCode).Inc()
+}
+
+// ObservePropagation - wait for one change batch to reach INSYNC. err is set
+// when it was still PENDING at the timeout or could not be read
+func ObservePropagation(duration time.Duration, err error) {
+	if err != nil {
+		route53Propagation.WithLabelValues("failure").Observe(duration.Seconds())
+		return
+	}
+
+	route53Propagation.WithLabelValues("success").Observe(duration.Seconds())
+}
+
+// ObserveReport - outcome of each change of one sync
+func ObserveReport(report model.SyncReport) {
+	for action, planned := range report.Planned {
+		switch {
+		case report.Refused:
+			changes.WithLabelValues(action, "refused").Add(float64(planned))
+			continue
+		case report.DryRun:
+			changes.WithLabelValues(action, "dry_run").Add(float64(planned))
+			continue
+		}
+
+		failed := report.Failed[action]
+		changes.WithLabelValues(action, "applied").Add(float64(planned - failed))
+		changes.WithLabelValues(action, "failed").Add(float64(failed))
+	}
+
+	for _, skipped := range report.Skipped {
+		changes.WithLabelValues(skipped.Action, "skipped").Inc()
+	}
+}
+
+// ObserveCycle - duration and outcome of one sync cycle
+func ObserveCycle(cycleType string, duration time.Duration, err error) {
+	cycleDuration.WithLabelValues(cycleType).Observe(duration.Seconds())
+
+	if err != nil {
+		cycles.WithLabelValues(cycleType, "failure").Inc()
+		return
+	}
+
+	cycles.WithLabelValues(cycleType, "success").Inc()
+	lastCycleSuccess.SetToCurrentTime()
+}
@@ -0,0 +1,70 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"vmc-dns-sync/pkg/model"
+
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestObservations(t *testing.T) {
+	ObserveSources(10, 8, 7)
+	assert.Equal(t, float64(10), testutil.ToFloat64(vmsFetched))
+	assert.Equal(t, float64(8), testutil.ToFloat64(mappedEntries))
+	assert.Equal(t, float64(7), testutil.ToFloat64(route53Records))
+
+	ObserveTriage(map[string]model.IPTriageSummary{
+		"host-1": {Result: model.IPTriageAddR53},
+		"host-2": {Result: model.IPTriageAddR53},
+		"host-3": {Result: model.IPTriageDeleteR53},
+	})
+	assert.Equal(t, float64(2), testutil.ToFloat64(triageResults.WithLabelValues("add")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(triageResults.WithLabelValues("delete")))
+	assert.Equal(t, float64(0), testutil.ToFloat64(triageResults.WithLabelValues("update")))
+
+	ObserveBatch("")
+	ObserveBatch("Throttling")
+	ObserveBatch("Throttling")
+	assert.Equal(t, float64(1), testutil.ToFloat64(route53Batches.WithLabelValues("success", "")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(route53Batches.WithLabelValues("failure", "Throttling")))
+
+	ObserveBatchRetry("PriorRequestNotComplete")
+	assert.Equal(t, float64(1), testutil.ToFloat64(route53BatchRetries.WithLabelValues("PriorRequestNotComplete")))
+
+	ObservePropagation(30*time.Second, nil)
+	ObservePropagation(5*time.Minute, fmt.Errorf("still PENDING"))
+	assert.Equal(t, 2, testutil.CollectAndCount(route53Propagation))
+
+	ObserveReport(model.SyncReport{
+		Planned: map[string]int{"add": 3, "delete": 1},
+		Failed:  map[string]int{"add": 1},
+		Skipped: []model.SkippedEntry{{Hostname: "host-4", Action: "add", Reason: "too long"}},
+	})
+	ObserveReport(model.SyncReport{DryRun: true, Planned: map[string]int{"update": 2}})
+	ObserveReport(model.SyncReport{Refused: true, Planned: map[string]int{"delete": 30}})
+	assert.Equal(t, float64(2), testutil.ToFloat64(changes.WithLabelValues("add", "applied")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(changes.WithLabelValues("add", "failed")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(changes.WithLabelValues("add", "skipped")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(changes.WithLabelValues("delete", "applied")))
+	assert.Equal(t, float64(2), testutil.ToFloat64(changes.WithLabelValues("update", "dry_run")))
+	assert.Equal(t, float64(30), testutil.ToFloat64(changes.WithLabelValues("delete", "refused")))
+
+	ObserveCycle("full", 2*time.Second, nil)
+	ObserveCycle("targeted", time.Second, fmt.Errorf("failed"))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cycles.WithLabelValues("full", "success")))
+	assert.Equal(t, float64(1), testutil.ToFloat64(cycles.WithLabelValues("targeted", "failure")))
+	assert.NotEqual(t, float64(0), testutil.ToFloat64(lastCycleSuccess))
+}
+
+func TestHandler(t *testing.T) {
+	recorder := httptest.NewRecorder()
+	Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+	assert.Equal(t, 200, recorder.Code)
+	assert.True(t, strings.Contains(recorder.Body.String(), "vmc_dns_sync_vms_fetched"))
+}
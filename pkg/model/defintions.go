@@ -1,5 +1,12 @@
 package model
 
+import (
+	"net"
+	"sort"
+	"strings"
+	"time"
+)
+
 const (
 	IPTriageNoChange  = iota
 	IPTriageDeleteR53 = iota
@@ -13,11 +20,267 @@ const (
 	IPTriageSourceBoth = iota
 )
 
+const (
+	MappingSourceConfigMap   = iota
+	MappingSourceVmDnsRecord = iota
+)
+
+// DNS record types triage tracks independently
+const (
+	RecordTypeA    = "A"
+	RecordTypeAAAA = "AAAA"
+)
+
+const recordKeySeparator = "#"
+
+// RecordKey - triage key of one record of a hostname. A records are keyed
+// by the hostname alone, other types get the type appended
+func RecordKey(httpEntry, recordType string) string {
+	if recordType == RecordTypeA || recordType == "" {
+		return httpEntry
+	}
+
+	return httpEntry + recordKeySeparator + recordType
+}
+
+// SplitRecordKey - hostname and record type of a RecordKey
+func SplitRecordKey(key string) (string, string) {
+	if i := strings.LastIndex(key, recordKeySeparator); i >= 0 {
+		return key[:i], key[i+len(recordKeySeparator):]
+	}
+
+	return key, RecordTypeA
+}
+
+const ipSetSeparator = ","
+
+// JoinIPs - canonical form of a set of IPs as stored in triage results:
+// sorted, without duplicates, comma separated. Two sets are equal
+// exactly when their canonical forms are
+func JoinIPs(ips []string) string {
+	seen := make(map[string]bool)
+	var unique []string
+
+	for _, ip := range ips {
+		if ip != "" && !seen[ip] {
+			seen[ip] = true
+			unique = append(unique, ip)
+		}
+	}
+	sort.Strings(unique)
+
+	return strings.Join(unique, ipSetSeparator)
+}
+
+// SplitIPs - the IPs of a set built by JoinIPs
+func SplitIPs(ips string) []string {
+	if ips == "" {
+		return nil
+	}
+
+	return strings.Split(ips, ipSetSeparator)
+}
+
+// IPTriageResultName - short name of an IPTriage* result for reports
+func IPTriageResultName(result int) string {
+	switch result {
+	case IPTriageNoChange:
+		return "no_change"
+	case IPTriageDeleteR53:
+		return "delete"
+	case IPTriageUpdateR53:
+		return "update"
+	case IPTriageAddR53:
+		return "add"
+	}
+
+	return "unknown"
+}
+
+// DNSRecord - one record set as listed by a DNS provider. IPs is in JoinIPs form.
+// Unowned is set for names held by a hand-made record or by another owner,
+// which are listed only so that triage never writes over them
+type DNSRecord struct {
+	IPs     string
+	TTL     int64
+	Unowned bool
+}
+
+// IPTriageSummary - triage of one record. R53IP and VmwIP are IP sets in JoinIPs form,
+// R53TTL the TTL the record has and VmwTTL the one the mapping asks for.
+// Unowned is set when a mapping asks for a name this sync does not own, in
+// which case the change is skipped. Zone is the zone named by the mapping.
+// Propagation is how long the change took to reach INSYNC, when waited for
 type IPTriageSummary struct {
+	HttpEntry   string
+	RecordType  string
+	Zone        string
+	R53IP       string
+	VmwIP       string
+	R53TTL      int64
+	VmwTTL      int64
+	Source      int
+	Result      int
+	Unowned     bool
+	ChangeID    string
+	SyncError   string
+	Propagation time.Duration
+}
+
+// DNSMapping - one hostname to VMs mapping read from Kubernetes. Pooled
+// hostnames list several VMs. Zone is the zone the mapping expects its record
+// in, when it names one. Selector holds only what the mapping itself overrides
+type DNSMapping struct {
 	HttpEntry string
-	R53IP     string
-	VmwIP     string
+	VMNames   []string
+	TTL       int64
+	Zone      string
 	Source    int
-	Result    int
+	Namespace string
+	Name      string
+	Selector  AddressSelector
+}
+
+// GuestNIC - one guest network interface as reported by VMware Tools
+type GuestNIC struct {
+	Network string
+	IPs     []string
 }
 
+// VMInfo - what VMware reports about the addresses of one VM.
+// PrimaryIP is summary.guest.ipAddress, NICs is guest.net in VMware order
+type VMInfo struct {
+	Name      string
+	PrimaryIP string
+	NICs      []GuestNIC
+}
+
+// AddressSelector - rule picking the published addresses of a VM out of
+// its NICs. Unset fields do not filter. NICIndex and PublishAll are nil when unset
+type AddressSelector struct {
+	Networks   []string
+	AllowCIDRs []*net.IPNet
+	DenyCIDRs  []*net.IPNet
+	NICIndex   *int
+	PublishAll *bool
+}
+
+// IsEmpty - true when no rule is set, in which case PrimaryIP is published
+func (s AddressSelector) IsEmpty() bool {
+	return len(s.Networks) == 0 && len(s.AllowCIDRs) == 0 && len(s.DenyCIDRs) == 0 && s.NICIndex == nil &&
+		!s.IsPublishAll()
+}
+
+// IsPublishAll - true when every matching address is published instead of
+// the first one per record type
+func (s AddressSelector) IsPublishAll() bool {
+	return s.PublishAll != nil && *s.PublishAll
+}
+
+// Override - s with every field that is set in o replaced by o's value
+func (s AddressSelector) Override(o AddressSelector) AddressSelector {
+	if len(o.Networks) > 0 {
+		s.Networks = o.Networks
+	}
+	if len(o.AllowCIDRs) > 0 {
+		s.AllowCIDRs = o.AllowCIDRs
+	}
+	if len(o.DenyCIDRs) > 0 {
+		s.DenyCIDRs = o.DenyCIDRs
+	}
+	if o.NICIndex != nil {
+		s.NICIndex = o.NICIndex
+	}
+	if o.PublishAll != nil {
+		s.PublishAll = o.PublishAll
+	}
+
+	return s
+}
+
+// DNSChange - one record set change handed to a DNS provider. IP and OldIP
+// are IP sets in JoinIPs form, TTL is the one to write and OldTTL the one
+// the record has. Zone, when set, is the zone the change must go to. The
+// provider fills in ChangeID or Error once the change has been sent, and
+// Propagation once it is known to have propagated
+type DNSChange struct {
+	Key         string
+	Name        string
+	RecordType  string
+	Zone        string
+	Action      int
+	IP          string
+	OldIP       string
+	TTL         int64
+	OldTTL      int64
+	ChangeID    string
+	Error       string
+	Propagation time.Duration
+}
+
+// BatchCounts - change batches a DNS provider sent, and how many of them were applied
+type BatchCounts struct {
+	Attempted int
+	Succeeded int
+}
+
+// SkippedEntry - triage entry left out of a sync, with the reason
+type SkippedEntry struct {
+	Hostname string
+	Action   string
+	Reason   string
+}
+
+// SyncReport - what one sync did. Having nothing to do or being a dry run is
+// an outcome reported here, errors are kept for syncs that failed. Refused is
+// set when the delete guard stopped the changes. Planned and Failed are keyed
+// by IPTriageResultName
+type SyncReport struct {
+	DryRun  bool
+	Refused bool
+	Planned map[string]int
+	Failed  map[string]int
+	Batches BatchCounts
+	Skipped []SkippedEntry
+}
+
+// NewSyncReport - report of the changes planned, before any is sent
+func NewSyncReport(changes []DNSChange, skipped []SkippedEntry) SyncReport {
+	report := SyncReport{Planned: make(map[string]int), Failed: make(map[string]int), Skipped: skipped}
+
+	for _, change := range changes {
+		report.Planned[IPTriageResultName(change.Action)]++
+	}
+
+	return report
+}
+
+// Total - number of changes planned
+func (r SyncReport) Total() int {
+	total := 0
+	for _, count := range r.Planned {
+		total += count
+	}
+
+	return total
+}
+
+// Applied - number of changes of an action the provider applied. Skipped
+// entries are never planned, refused and dry runs apply nothing
+func (r SyncReport) Applied(action string) int {
+	if r.Refused || r.DryRun {
+		return 0
+	}
+
+	return r.Planned[action] - r.Failed[action]
+}
+
+// TotalFailed - number of changes the provider did not apply
+func (r SyncReport) TotalFailed() int {
+	total := 0
+	for _, count := range r.Failed {
+		total += count
+	}
+
+	return total
+}
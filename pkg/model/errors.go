@@ -0,0 +1,64 @@
+package model
+
+import (
+	"fmt"
+)
+
+// Ways a sync fails. Callers tell them apart with errors.As rather than by
+// the text of the error. Syncs that did not fail are described by a SyncReport
+
+// SourceError - a source of the triage could not be read completely. The cycle
+// is not reconciled, as records missing from a source would look orphaned and be deleted
+type SourceError struct {
+	Source string
+	Err    error
+}
+
+func (e *SourceError) Error() string {
+	return fmt.Sprintf("%s could not be read: %v", e.Source, e.Err)
+}
+
+func (e *SourceError) Unwrap() error {
+	return e.Err
+}
+
+// BatchError - at least one batch of changes failed. Each failed change has
+// its own Error set
+type BatchError struct {
+	Failed int
+	Total  int
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("%d of %d changes failed", e.Failed, e.Total)
+}
+
+// GuardError - the delete guard refused a plan with more deletes than its limits
+type GuardError struct {
+	Deletes    int
+	Existing   int
+	MaxDeletes int
+	MaxPercent int
+}
+
+func (e *GuardError) Error() string {
+	return fmt.Sprintf("refusing to delete %d of %d records (limits: %d records, %d%%). "+
+		"Check the VMware and Kubernetes sources, or set R53_ALLOW_MASS_DELETE=TRUE to override",
+		e.Deletes, e.Existing, e.MaxDeletes, e.MaxPercent)
+}
+
+// NewBatchError - BatchError for the changes whose Error is set, nil when none is
+func NewBatchError(changes []DNSChange) error {
+	failed := 0
+	for _, change := range changes {
+		if change.Error != "" {
+			failed++
+		}
+	}
+
+	if failed == 0 {
+		return nil
+	}
+
+	return &BatchError{Failed: failed, Total: len(changes)}
+}
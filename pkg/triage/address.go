@@ -0,0 +1,79 @@
+package triage
+
+import (
+	"net"
+	"vmc-dns-sync/pkg/model"
+)
+
+func containsNetwork(networks []string, network string) bool {
+	for _, each := range networks {
+		if each == network {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsIP(cidrs []*net.IPNet, ip net.IP) bool {
+	for _, cidr := range cidrs {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func isAddressAllowed(selector model.AddressSelector, ip string) bool {
+	parsed := net.ParseIP(ip)
+
+	if parsed == nil || containsIP(selector.DenyCIDRs, parsed) {
+		return false
+	}
+
+	return len(selector.AllowCIDRs) == 0 || containsIP(selector.AllowCIDRs, parsed)
+}
+
+// selectAddresses - addresses of a VM to publish. Without a selector this is
+// the primary IP VMware Tools reports. With one, NICs are walked in VMware
+// order and the first allowed address of each record type wins, or every
+// allowed address when the selector publishes all
+func selectAddresses(vm model.VMInfo, selector model.AddressSelector) []string {
+	if selector.IsEmpty() {
+		if getRecordType(vm.PrimaryIP) == "" {
+			return nil
+		}
+		return []string{vm.PrimaryIP}
+	}
+
+	var addresses []string
+	seen := make(map[string]bool)
+
+	for i, nic := range vm.NICs {
+		if selector.NICIndex != nil && *selector.NICIndex != i {
+			continue
+		}
+
+		if len(selector.Networks) > 0 && !containsNetwork(selector.Networks, nic.Network) {
+			continue
+		}
+
+		for _, ip := range nic.IPs {
+			recordType := getRecordType(ip)
+
+			if recordType == "" || !isAddressAllowed(selector, ip) {
+				continue
+			}
+
+			if seen[recordType] && !selector.IsPublishAll() {
+				continue
+			}
+
+			seen[recordType] = true
+			addresses = append(addresses, ip)
+		}
+	}
+
+	return addresses
+}
@@ -0,0 +1,78 @@
+package triage
+
+import (
+	"github.com/stretchr/testify/assert"
+	"net"
+	"testing"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+)
+
+func mustCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		assert.Nil(t, err)
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func TestSelectAddresses(t *testing.T) {
+	vm := model.VMInfo{
+		Name:      "builder-1",
+		PrimaryIP: "192.168.10.5",
+		NICs: []model.GuestNIC{
+			{Network: "mgmt", IPs: []string{"192.168.10.5", "fe80::1"}},
+			{Network: "public", IPs: []string{"10.20.0.5", "2001:db8::5", "10.20.0.6"}},
+			{Network: "backup", IPs: []string{"172.16.0.5"}},
+		},
+	}
+	second := 1
+
+	// no rule keeps the old behaviour
+	assert.Equal(t, []string{"192.168.10.5"}, selectAddresses(vm, model.AddressSelector{}))
+
+	assert.Equal(t, []string{"10.20.0.5", "2001:db8::5"},
+		selectAddresses(vm, model.AddressSelector{Networks: []string{"public"}}))
+	assert.Equal(t, []string{"10.20.0.5", "2001:db8::5"},
+		selectAddresses(vm, model.AddressSelector{NICIndex: &second}))
+	assert.Equal(t, []string{"172.16.0.5"},
+		selectAddresses(vm, model.AddressSelector{AllowCIDRs: mustCIDRs(t, "172.16.0.0/12")}))
+	assert.Equal(t, []string{"10.20.0.6"},
+		selectAddresses(vm, model.AddressSelector{Networks: []string{"public"},
+			DenyCIDRs: mustCIDRs(t, "10.20.0.5/32", "2001:db8::/32")}))
+
+	all := true
+	assert.Equal(t, []string{"10.20.0.5", "2001:db8::5", "10.20.0.6"},
+		selectAddresses(vm, model.AddressSelector{Networks: []string{"public"}, PublishAll: &all}))
+	assert.Equal(t, []string{"192.168.10.5", "10.20.0.5", "2001:db8::5", "10.20.0.6", "172.16.0.5"},
+		selectAddresses(vm, model.AddressSelector{PublishAll: &all}))
+
+	// a rule matching nothing publishes nothing, not the primary IP
+	assert.Empty(t, selectAddresses(vm, model.AddressSelector{Networks: []string{"missing"}}))
+}
+
+func TestAddressSelectionOverride(t *testing.T) {
+	vms := map[string]model.VMInfo{
+		"builder-1": {
+			Name:      "builder-1",
+			PrimaryIP: "192.168.10.5",
+			NICs: []model.GuestNIC{
+				{Network: "mgmt", IPs: []string{"192.168.10.5"}},
+				{Network: "public", IPs: []string{"10.20.0.5"}},
+			},
+		},
+	}
+	mappings := map[string]model.DNSMapping{
+		"http://global": {HttpEntry: "http://global", VMNames: []string{"builder-1"}},
+		"http://mgmt": {HttpEntry: "http://mgmt", VMNames: []string{"builder-1"},
+			Selector: model.AddressSelector{Networks: []string{"mgmt"}}},
+	}
+
+	result := IPTriage(logging.Discard(), vms, map[string]model.DNSRecord{}, mappings,
+		model.AddressSelector{Networks: []string{"public"}}, testTTL)
+
+	assert.Equal(t, "10.20.0.5", result["http://global"].VmwIP)
+	assert.Equal(t, "192.168.10.5", result["http://mgmt"].VmwIP)
+}
@@ -0,0 +1,81 @@
+package triage
+
+import (
+	"strconv"
+	"strings"
+	"vmc-dns-sync/pkg/dns_api"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+)
+
+// If a source comes back empty or partial (e.g. a permissions change
+// hides a datacenter), every record looks orphaned and triage plans
+// to delete the whole zone. The guard refuses such plans unless an
+// operator explicitly allows them.
+
+// small zones are protected by the absolute limit only - deleting
+// 1 of 2 records is routine, not a mass deletion
+const minRecordsForPercentGuard = 10
+
+func getEnvInt(name string, defaultValue int) int {
+	value, err := strconv.Atoi(dns_api.GetEnv(name))
+
+	if err != nil || value < 0 {
+		return defaultValue
+	}
+
+	return value
+}
+
+func getMaxDeletes() int {
+	return getEnvInt("R53_MAX_DELETES", 25)
+}
+
+func getMaxDeletePercent() int {
+	return getEnvInt("R53_MAX_DELETE_PERCENT", 50)
+}
+
+func isMassDeleteAllowed() bool {
+	return strings.ToUpper(dns_api.GetEnv("R53_ALLOW_MASS_DELETE")) == "TRUE"
+}
+
+func countDeletes(triageResult map[string]model.IPTriageSummary) (int, int) {
+	// returns planned deletes and existing records
+	deletes, existing := 0, 0
+
+	for _, summary := range triageResult {
+		if summary.Source == model.IPTriageSourceR53 || summary.Source == model.IPTriageSourceBoth {
+			existing++
+		}
+		if summary.Result == model.IPTriageDeleteR53 {
+			deletes++
+		}
+	}
+
+	return deletes, existing
+}
+
+// CheckDeleteGuard - refuses a plan whose deletes exceed R53_MAX_DELETES records
+// or R53_MAX_DELETE_PERCENT of the existing records, unless R53_ALLOW_MASS_DELETE=TRUE
+func CheckDeleteGuard(logger *logging.Logger, triageResult map[string]model.IPTriageSummary) error {
+	deletes, existing := countDeletes(triageResult)
+	maxDeletes := getMaxDeletes()
+	maxPercent := getMaxDeletePercent()
+
+	exceeded := deletes > maxDeletes
+	if existing >= minRecordsForPercentGuard && deletes*100 > maxPercent*existing {
+		exceeded = true
+	}
+
+	if !exceeded {
+		return nil
+	}
+
+	if isMassDeleteAllowed() {
+		logger.Warn("Plan deletes more records than the guard limits. Proceeding as R53_ALLOW_MASS_DELETE=TRUE",
+			"deletes", deletes, "existing", existing)
+		return nil
+	}
+
+	return &model.GuardError{Deletes: deletes, Existing: existing, MaxDeletes: maxDeletes, MaxPercent: maxPercent}
+}
@@ -0,0 +1,85 @@
+package triage
+
+import (
+	"context"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/model"
+	"os"
+	"testing"
+)
+
+func buildTriage(keep, deletes int) map[string]model.IPTriageSummary {
+	triageResult := make(map[string]model.IPTriageSummary)
+
+	for i := 0; i < keep; i++ {
+		triageResult[fmt.Sprintf("keep-%d", i)] = model.IPTriageSummary{
+			Source: model.IPTriageSourceBoth,
+			Result: model.IPTriageNoChange,
+		}
+	}
+	for i := 0; i < deletes; i++ {
+		triageResult[fmt.Sprintf("delete-%d", i)] = model.IPTriageSummary{
+			Source: model.IPTriageSourceR53,
+			Result: model.IPTriageDeleteR53,
+		}
+	}
+	triageResult["add"] = model.IPTriageSummary{
+		Source: model.IPTriageSourceVMW,
+		Result: model.IPTriageAddR53,
+	}
+
+	return triageResult
+}
+
+func TestGuardLimits(t *testing.T) {
+	assert.Equal(t, 25, getMaxDeletes())
+	assert.Equal(t, 50, getMaxDeletePercent())
+	assert.False(t, isMassDeleteAllowed())
+
+	os.Setenv("R53_MAX_DELETES", "invalid")
+	defer os.Unsetenv("R53_MAX_DELETES")
+	assert.Equal(t, 25, getMaxDeletes())
+
+	os.Setenv("R53_MAX_DELETES", "5")
+	assert.Equal(t, 5, getMaxDeletes())
+}
+
+func TestGuardAllowsNormalPlans(t *testing.T) {
+	deletes, existing := countDeletes(buildTriage(20, 3))
+	assert.Equal(t, 3, deletes)
+	assert.Equal(t, 23, existing)
+
+	assert.Nil(t, CheckDeleteGuard(logging.Discard(), buildTriage(20, 3)))
+	// small zones only use the absolute limit
+	assert.Nil(t, CheckDeleteGuard(logging.Discard(), buildTriage(1, 2)))
+}
+
+func TestGuardRefusesMassDeletes(t *testing.T) {
+	// an empty VMware source turns the whole zone into deletes
+	err := CheckDeleteGuard(logging.Discard(), buildTriage(0, 12))
+	assert.IsType(t, &model.GuardError{}, err)
+
+	err = CheckDeleteGuard(logging.Discard(), buildTriage(100, 26))
+	assert.Equal(t, &model.GuardError{Deletes: 26, Existing: 126, MaxDeletes: 25, MaxPercent: 50}, err)
+
+	os.Setenv("R53_ALLOW_MASS_DELETE", "TRUE")
+	defer os.Unsetenv("R53_ALLOW_MASS_DELETE")
+	assert.Nil(t, CheckDeleteGuard(logging.Discard(), buildTriage(0, 12)))
+}
+
+func TestGuardStopsSync(t *testing.T) {
+	var p providerTest
+
+	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
+	applyChangesMock = func(changes []model.DNSChange) error {
+		t.Fatal("guarded plan must not reach the provider")
+		return nil
+	}
+
+	report, err := SyncDNS(context.Background(), logging.Discard(), buildTriage(0, 30), p)
+	assert.IsType(t, &model.GuardError{}, err)
+	assert.True(t, report.Refused)
+	assert.Equal(t, 30, report.Planned["delete"])
+}
@@ -0,0 +1,199 @@
+package triage
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"text/tabwriter"
+	"time"
+	"vmc-dns-sync/pkg/model"
+)
+
+// Plan is the reviewable form of a triage result: the adds, updates
+// and deletes that an apply would send, with the IPs they were based on.
+// It can be saved by the plan command and applied later.
+type Plan struct {
+	CreatedAt time.Time    `json:"createdAt"`
+	Zone      string       `json:"zone"`
+	Changes   []PlanChange `json:"changes"`
+}
+
+type PlanChange struct {
+	HttpEntry  string `json:"host"`
+	RecordType string `json:"type"`
+	Action     string `json:"action"`
+	OldIP      string `json:"oldIp,omitempty"`
+	NewIP      string `json:"newIp,omitempty"`
+	OldTTL     int64  `json:"oldTtl,omitempty"`
+	NewTTL     int64  `json:"newTtl,omitempty"`
+}
+
+// key - triage key of the record the change is for
+func (c PlanChange) key() string {
+	return model.RecordKey(c.HttpEntry, c.RecordType)
+}
+
+// BuildPlan - changes of a triage result, sorted by host. No-change entries, and
+// adds for names this sync does not own, are left out as they are never sent
+func BuildPlan(triageResult map[string]model.IPTriageSummary, zone string, now time.Time) Plan {
+	plan := Plan{
+		CreatedAt: now.UTC(),
+		Zone:      zone,
+		Changes:   []PlanChange{},
+	}
+
+	for key, summary := range triageResult {
+		if summary.Result == model.IPTriageNoChange || summary.Unowned {
+			continue
+		}
+
+		httpEntry, recordType := model.SplitRecordKey(key)
+		plan.Changes = append(plan.Changes, PlanChange{
+			HttpEntry:  httpEntry,
+			RecordType: recordType,
+			Action:     model.IPTriageResultName(summary.Result),
+			OldIP:      summary.R53IP,
+			NewIP:      summary.VmwIP,
+			OldTTL:     summary.R53TTL,
+			NewTTL:     summary.VmwTTL,
+		})
+	}
+
+	sort.Slice(plan.Changes, func(i, j int) bool {
+		return plan.Changes[i].key() < plan.Changes[j].key()
+	})
+
+	return plan
+}
+
+// Counts - number of changes per action
+func (p Plan) Counts() map[string]int {
+	counts := make(map[string]int)
+
+	for _, change := range p.Changes {
+		counts[change.Action]++
+	}
+
+	return counts
+}
+
+// WriteTable - human readable form of the plan
+func (p Plan) WriteTable(w io.Writer) error {
+	if len(p.Changes) == 0 {
+		_, err := fmt.Fprintln(w, "No changes. DNS records are in sync.")
+		return err
+	}
+
+	table := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "ACTION\tHOST\tTYPE\tOLD IP\tNEW IP\tTTL")
+	for _, change := range p.Changes {
+		fmt.Fprintf(table, "%s\t%s\t%s\t%s\t%s\t%s\n", change.Action, change.HttpEntry, change.RecordType,
+			valueOrDash(change.OldIP), valueOrDash(change.NewIP), ttlChange(change.OldTTL, change.NewTTL))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+
+	counts := p.Counts()
+	_, err := fmt.Fprintf(w, "\nPlan: %d to add, %d to update, %d to delete.\n",
+		counts["add"], counts["update"], counts["delete"])
+	return err
+}
+
+// WriteJSON - machine readable form of the plan, also the saved plan file format
+func (p Plan) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(p)
+}
+
+// LoadPlan - reads a plan saved by the plan command
+func LoadPlan(path string) (Plan, error) {
+	var plan Plan
+
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return plan, err
+	}
+
+	err = json.Unmarshal(content, &plan)
+	return plan, err
+}
+
+// CheckPlanFresh - a saved plan is only applied if it is younger than maxAge,
+// targets the same zone and every host still has the IPs and TTLs the plan saw
+func CheckPlanFresh(plan Plan, current map[string]model.IPTriageSummary, zone string,
+	maxAge time.Duration, now time.Time) error {
+	if age := now.Sub(plan.CreatedAt); age > maxAge {
+		return fmt.Errorf("plan is stale: created %s ago, limit is %s", age.Round(time.Second), maxAge)
+	}
+
+	if plan.Zone != zone {
+		return fmt.Errorf("plan is for zone %s, not %s", plan.Zone, zone)
+	}
+
+	for _, change := range plan.Changes {
+		summary := current[change.key()]
+
+		if summary.R53IP != change.OldIP || summary.VmwIP != change.NewIP {
+			return fmt.Errorf("plan is stale: %s is now R53 '%s' / VMW '%s', plan saw '%s' / '%s'",
+				change.HttpEntry, summary.R53IP, summary.VmwIP, change.OldIP, change.NewIP)
+		}
+
+		if summary.R53TTL != change.OldTTL || summary.VmwTTL != change.NewTTL {
+			return fmt.Errorf("plan is stale: %s now has TTL R53 %d / VMW %d, plan saw %d / %d",
+				change.HttpEntry, summary.R53TTL, summary.VmwTTL, change.OldTTL, change.NewTTL)
+		}
+	}
+
+	return nil
+}
+
+// Restrict - the current triage with every change that is not in the plan
+// turned into a no-change, so an apply sends exactly what was reviewed while
+// the delete guard still sees the whole zone. Check freshness first
+func (p Plan) Restrict(current map[string]model.IPTriageSummary) map[string]model.IPTriageSummary {
+	planned := make(map[string]bool)
+	for _, change := range p.Changes {
+		planned[change.key()] = true
+	}
+
+	result := make(map[string]model.IPTriageSummary)
+	for key, summary := range current {
+		if !planned[key] {
+			summary.Result = model.IPTriageNoChange
+		}
+		result[key] = summary
+	}
+
+	return result
+}
+
+func ttlChange(oldTTL, newTTL int64) string {
+	switch {
+	case oldTTL == newTTL || oldTTL == 0:
+		return valueOrDash(ttlString(newTTL))
+	case newTTL == 0:
+		return ttlString(oldTTL)
+	}
+
+	return fmt.Sprintf("%d -> %d", oldTTL, newTTL)
+}
+
+func ttlString(ttl int64) string {
+	if ttl == 0 {
+		return ""
+	}
+
+	return fmt.Sprintf("%d", ttl)
+}
+
+func valueOrDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+
+	return value
+}
@@ -0,0 +1,116 @@
+package triage
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"vmc-dns-sync/pkg/model"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var planTime = time.Date(2021, 3, 1, 12, 0, 0, 0, time.UTC)
+
+func samplePlanTriage() map[string]model.IPTriageSummary {
+	return map[string]model.IPTriageSummary{
+		"http://same":     {HttpEntry: "http://same", R53IP: "10.0.0.1", VmwIP: "10.0.0.1", Source: model.IPTriageSourceBoth, Result: model.IPTriageNoChange},
+		"http://slow":     {HttpEntry: "http://slow", R53IP: "10.0.0.5", VmwIP: "10.0.0.5", R53TTL: 60, VmwTTL: 300, Source: model.IPTriageSourceBoth, Result: model.IPTriageUpdateR53},
+		"http://moved":    {HttpEntry: "http://moved", R53IP: "10.0.0.2", VmwIP: "10.0.1.2", Source: model.IPTriageSourceBoth, Result: model.IPTriageUpdateR53},
+		"http://new":      {HttpEntry: "http://new", VmwIP: "10.0.0.3", Source: model.IPTriageSourceVMW, Result: model.IPTriageAddR53},
+		"http://orphan":   {HttpEntry: "http://orphan", R53IP: "10.0.0.4", Source: model.IPTriageSourceR53, Result: model.IPTriageDeleteR53},
+		"http://new#AAAA": {HttpEntry: "http://new", RecordType: model.RecordTypeAAAA, VmwIP: "2001:db8::3", Source: model.IPTriageSourceVMW, Result: model.IPTriageAddR53},
+	}
+}
+
+func TestResultNames(t *testing.T) {
+	assert.Equal(t, "no_change", model.IPTriageResultName(model.IPTriageNoChange))
+	assert.Equal(t, "delete", model.IPTriageResultName(model.IPTriageDeleteR53))
+	assert.Equal(t, "update", model.IPTriageResultName(model.IPTriageUpdateR53))
+	assert.Equal(t, "add", model.IPTriageResultName(model.IPTriageAddR53))
+	assert.Equal(t, "unknown", model.IPTriageResultName(400))
+}
+
+func TestBuildPlan(t *testing.T) {
+	plan := BuildPlan(samplePlanTriage(), "ZONE1", planTime)
+
+	assert.Equal(t, "ZONE1", plan.Zone)
+	assert.Equal(t, []PlanChange{
+		{HttpEntry: "http://moved", RecordType: "A", Action: "update", OldIP: "10.0.0.2", NewIP: "10.0.1.2"},
+		{HttpEntry: "http://new", RecordType: "A", Action: "add", NewIP: "10.0.0.3"},
+		{HttpEntry: "http://new", RecordType: "AAAA", Action: "add", NewIP: "2001:db8::3"},
+		{HttpEntry: "http://orphan", RecordType: "A", Action: "delete", OldIP: "10.0.0.4"},
+		{HttpEntry: "http://slow", RecordType: "A", Action: "update", OldIP: "10.0.0.5", NewIP: "10.0.0.5", OldTTL: 60, NewTTL: 300},
+	}, plan.Changes)
+	assert.Equal(t, map[string]int{"add": 2, "update": 2, "delete": 1}, plan.Counts())
+
+	var table bytes.Buffer
+	assert.Nil(t, plan.WriteTable(&table))
+	assert.True(t, strings.Contains(table.String(), "update  http://moved   A     10.0.0.2  10.0.1.2"))
+	assert.True(t, strings.Contains(table.String(), "add     http://new     AAAA  -         2001:db8::3"))
+	assert.True(t, strings.Contains(table.String(), "update  http://slow    A     10.0.0.5  10.0.0.5     60 -> 300"))
+	assert.True(t, strings.HasSuffix(table.String(), "Plan: 2 to add, 2 to update, 1 to delete.\n"))
+
+	table.Reset()
+	assert.Nil(t, BuildPlan(map[string]model.IPTriageSummary{}, "ZONE1", planTime).WriteTable(&table))
+	assert.Equal(t, "No changes. DNS records are in sync.\n", table.String())
+}
+
+func TestPlanRoundTrip(t *testing.T) {
+	plan := BuildPlan(samplePlanTriage(), "ZONE1", planTime)
+	path := filepath.Join(t.TempDir(), "plan.json")
+
+	var content bytes.Buffer
+	assert.Nil(t, plan.WriteJSON(&content))
+	assert.Nil(t, ioutil.WriteFile(path, content.Bytes(), 0600))
+
+	loaded, err := LoadPlan(path)
+	assert.Nil(t, err)
+	assert.Equal(t, plan, loaded)
+
+	_, err = LoadPlan(filepath.Join(t.TempDir(), "missing.json"))
+	assert.NotNil(t, err)
+}
+
+func TestPlanFreshness(t *testing.T) {
+	plan := BuildPlan(samplePlanTriage(), "ZONE1", planTime)
+	current := samplePlanTriage()
+
+	assert.Nil(t, CheckPlanFresh(plan, current, "ZONE1", 15*time.Minute, planTime.Add(time.Minute)))
+
+	err := CheckPlanFresh(plan, current, "ZONE1", 15*time.Minute, planTime.Add(time.Hour))
+	assert.True(t, strings.HasPrefix(err.Error(), "plan is stale: created 1h0m0s ago"))
+
+	err = CheckPlanFresh(plan, current, "ZONE2", 15*time.Minute, planTime)
+	assert.NotNil(t, err)
+
+	// the VM moved again since the plan was made
+	moved := current["http://moved"]
+	moved.VmwIP = "10.0.2.2"
+	current["http://moved"] = moved
+	err = CheckPlanFresh(plan, current, "ZONE1", 15*time.Minute, planTime)
+	assert.True(t, strings.HasPrefix(err.Error(), "plan is stale: http://moved"))
+	current["http://moved"] = samplePlanTriage()["http://moved"]
+
+	// someone changed the TTL by hand
+	slow := current["http://slow"]
+	slow.R53TTL = 120
+	current["http://slow"] = slow
+	err = CheckPlanFresh(plan, current, "ZONE1", 15*time.Minute, planTime)
+	assert.True(t, strings.HasPrefix(err.Error(), "plan is stale: http://slow now has TTL"))
+}
+
+func TestPlanRestrict(t *testing.T) {
+	plan := BuildPlan(samplePlanTriage(), "ZONE1", planTime)
+	current := samplePlanTriage()
+	current["http://unreviewed"] = model.IPTriageSummary{VmwIP: "10.0.0.9", Result: model.IPTriageAddR53}
+
+	result := plan.Restrict(current)
+	assert.Equal(t, 7, len(result))
+	assert.Equal(t, model.IPTriageNoChange, result["http://unreviewed"].Result)
+	assert.Equal(t, model.IPTriageUpdateR53, result["http://moved"].Result)
+	assert.Equal(t, model.IPTriageAddR53, result["http://new"].Result)
+	assert.Equal(t, model.IPTriageAddR53, result["http://new#AAAA"].Result)
+	assert.Equal(t, model.IPTriageDeleteR53, result["http://orphan"].Result)
+}
@@ -1,48 +1,102 @@
 package triage
 
 import (
-	"fmt"
-	"log"
-	"strings"
+	"context"
+	"net"
 	"vmc-dns-sync/pkg/dns_api"
+	"vmc-dns-sync/pkg/logging"
 	"vmc-dns-sync/pkg/model"
 )
 
-func isDryRun() bool {
+// IsDryRun - anything other than R53_UPDATE_DRY_RUN=FALSE is a dry run
+func IsDryRun() bool {
 	dryRun := dns_api.GetEnv("R53_UPDATE_DRY_RUN")
 
 	return dryRun != "FALSE"
 }
 
-func mapVMCNameToIP(k8sDNSToBuilderMap, vmcBuilderToIPMap map[string]string) map[string]string {
-	result := make(map[string]string)
+// getRecordType - A for IPv4, AAAA for IPv6. Empty for addresses that
+// must not be published: link-local ones and anything that is not an IP
+func getRecordType(ip string) string {
+	parsed := net.ParseIP(ip)
 
-	for key := range k8sDNSToBuilderMap {
-		builder := k8sDNSToBuilderMap[key]
+	switch {
+	case parsed == nil:
+		return ""
+	case parsed.IsLinkLocalUnicast():
+		return ""
+	case parsed.To4() != nil:
+		return model.RecordTypeA
+	}
+
+	return model.RecordTypeAAAA
+}
+
+func mapVMCNameToIP(logger *logging.Logger, k8sDNSToBuilderMap map[string]model.DNSMapping, vmcBuilderToVMMap map[string]model.VMInfo,
+	defaultSelector model.AddressSelector, defaultTTL int64) map[string]model.DNSRecord {
+	// keyed by record, so a hostname gets an A and/or an AAAA record depending on the VM addresses.
+	// Every VM of a pooled hostname adds its addresses to the same record set
+	result := make(map[string]model.DNSRecord)
+
+	for key, mapping := range k8sDNSToBuilderMap {
+		selector := defaultSelector.Override(mapping.Selector)
+		ttl := mapping.TTL
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+
+		recordIPs := make(map[string][]string)
+
+		for _, vmName := range mapping.VMNames {
+			vm, ok := vmcBuilderToVMMap[vmName]
+			if !ok {
+				continue
+			}
+
+			addresses := selectAddresses(vm, selector)
+			if len(addresses) == 0 {
+				logger.Warn("VM has no address matching the selection. Skipping", logging.FieldVM, vmName,
+					logging.FieldHostname, key)
+				continue
+			}
+
+			for _, vmcIP := range addresses {
+				recordType := getRecordType(vmcIP)
+				recordIPs[recordType] = append(recordIPs[recordType], vmcIP)
+			}
+		}
 
-		if vmcIP, ok := vmcBuilderToIPMap[builder]; ok {
-			result[key] = vmcIP
+		for recordType, ips := range recordIPs {
+			result[model.RecordKey(key, recordType)] = model.DNSRecord{IPs: model.JoinIPs(ips), TTL: ttl}
 		}
 	}
 
 	return result
 }
 
-func isVMCv6(ip string) bool {
-	// checks if vmware has reported ipv6 instead of ipv4
-	return strings.Contains(ip, "::")
-}
-
-func IPTriage(vmcBuilderToIPMap, awsDNSToIPMap, k8sDNSToBuilderMap map[string]string) map[string]model.IPTriageSummary {
+// IPTriage - compares VMware addresses with the provider records. Both maps on the
+// DNS side are keyed by model.RecordKey, so each record type is triaged on its own.
+// defaultSelector is the global address selection and defaultTTL the TTL of
+// mappings without one. Mappings may override both. A record whose TTL drifted
+// from the wanted one is updated even when its IPs are right. Unowned records
+// are never deleted, and a mapping asking for one is triaged as an Unowned add
+func IPTriage(logger *logging.Logger, vmcBuilderToVMMap map[string]model.VMInfo, awsDNSToIPMap map[string]model.DNSRecord,
+	k8sDNSToBuilderMap map[string]model.DNSMapping, defaultSelector model.AddressSelector,
+	defaultTTL int64) map[string]model.IPTriageSummary {
 	result := make(map[string]model.IPTriageSummary)
 
-	vmcIPMap := mapVMCNameToIP(k8sDNSToBuilderMap, vmcBuilderToIPMap)
+	vmcIPMap := mapVMCNameToIP(logger, k8sDNSToBuilderMap, vmcBuilderToVMMap, defaultSelector, defaultTTL)
 
-	for key := range awsDNSToIPMap {
+	for key, record := range awsDNSToIPMap {
 		var currentTriage model.IPTriageSummary
 
-		currentTriage.HttpEntry = key
-		currentTriage.R53IP = awsDNSToIPMap[key]
+		if record.Unowned {
+			continue
+		}
+
+		currentTriage.HttpEntry, currentTriage.RecordType = model.SplitRecordKey(key)
+		currentTriage.R53IP = record.IPs
+		currentTriage.R53TTL = record.TTL
 		currentTriage.Source = model.IPTriageSourceR53
 		currentTriage.Result = model.IPTriageDeleteR53
 
@@ -50,15 +104,17 @@ func IPTriage(vmcBuilderToIPMap, awsDNSToIPMap, k8sDNSToBuilderMap map[string]st
 	}
 
 	for key := range vmcIPMap {
+		httpEntry, _ := model.SplitRecordKey(key)
+
 		if currentTriage, ok := result[key]; ok {
+			currentTriage.Zone = k8sDNSToBuilderMap[httpEntry].Zone
 			currentTriage.Source = model.IPTriageSourceBoth
-			currentTriage.VmwIP = vmcIPMap[key]
+			currentTriage.VmwIP = vmcIPMap[key].IPs
+			currentTriage.VmwTTL = vmcIPMap[key].TTL
 
-			if currentTriage.VmwIP == currentTriage.R53IP {
+			// both sides are in JoinIPs form, so this compares the IP sets
+			if currentTriage.VmwIP == currentTriage.R53IP && currentTriage.VmwTTL == currentTriage.R53TTL {
 				currentTriage.Result = model.IPTriageNoChange
-			} else if isVMCv6(currentTriage.VmwIP) {
-				log.Printf("VMW %s has reported v6 IP %s. We will ignore/delete R53 instead of updating", currentTriage.HttpEntry, currentTriage.VmwIP)
-				currentTriage.Result = model.IPTriageDeleteR53
 			} else {
 				currentTriage.Result = model.IPTriageUpdateR53
 			}
@@ -66,16 +122,20 @@ func IPTriage(vmcBuilderToIPMap, awsDNSToIPMap, k8sDNSToBuilderMap map[string]st
 		} else {
 			var currentTriage model.IPTriageSummary
 
-			currentTriage.HttpEntry = key
-			currentTriage.VmwIP = vmcIPMap[key]
-			if !isVMCv6(currentTriage.VmwIP) {
-				currentTriage.Result = model.IPTriageAddR53
-			} else {
-				log.Printf("VMW %s has reported v6 IP %s. We will ignore/delete R53 instead of updating", currentTriage.HttpEntry, currentTriage.VmwIP)
-				currentTriage.Result = model.IPTriageNoChange
-			}
+			currentTriage.HttpEntry, currentTriage.RecordType = model.SplitRecordKey(key)
+			currentTriage.Zone = k8sDNSToBuilderMap[httpEntry].Zone
+			currentTriage.VmwIP = vmcIPMap[key].IPs
+			currentTriage.VmwTTL = vmcIPMap[key].TTL
+			currentTriage.Result = model.IPTriageAddR53
 			currentTriage.Source = model.IPTriageSourceVMW
 
+			// a hand-made record or another owner holds the name
+			if record, ok := awsDNSToIPMap[key]; ok && record.Unowned {
+				currentTriage.R53IP = record.IPs
+				currentTriage.R53TTL = record.TTL
+				currentTriage.Unowned = true
+			}
+
 			result[key] = currentTriage
 		}
 	}
@@ -83,39 +143,151 @@ func IPTriage(vmcBuilderToIPMap, awsDNSToIPMap, k8sDNSToBuilderMap map[string]st
 	return result
 }
 
-func SyncRoute53(triageResult map[string]model.IPTriageSummary,
-				awsHelper dns_api.AwsHelperInterface) error {
-	log.Println("Starting final sync")
+// HostsForVMs - http entries mapped to any of the given VM names
+func HostsForVMs(k8sDNSToBuilderMap map[string]model.DNSMapping, vmNames []string) map[string]bool {
+	wanted := make(map[string]bool)
+	for _, vmName := range vmNames {
+		wanted[vmName] = true
+	}
+
+	hosts := make(map[string]bool)
+	for key, mapping := range k8sDNSToBuilderMap {
+		for _, vmName := range mapping.VMNames {
+			if wanted[vmName] {
+				hosts[key] = true
+			}
+		}
+	}
+
+	return hosts
+}
+
+// FilterTriage - narrow a triage result down to the records of the given
+// http entries. Used for targeted reconciles triggered by watch events
+func FilterTriage(triageResult map[string]model.IPTriageSummary, hosts map[string]bool) map[string]model.IPTriageSummary {
+	result := make(map[string]model.IPTriageSummary)
 
 	for key := range triageResult {
-		log.Printf("Host - %s, R53 - %s, VMW - %s\n", key, triageResult[key].R53IP, triageResult[key].VmwIP)
+		if hosts[triageResult[key].HttpEntry] {
+			result[key] = triageResult[key]
+		}
+	}
+
+	return result
+}
+
+func logTriage(logger *logging.Logger, triageResult map[string]model.IPTriageSummary) {
+	for _, summary := range triageResult {
+		var msg string
 
-		switch triageResult[key].Result {
+		switch summary.Result {
 		case model.IPTriageNoChange:
-			log.Println("No change in IP - no action needed")
+			msg = "No change in IP - no action needed"
 		case model.IPTriageUpdateR53:
-			log.Println("R53 IP is different. Updating R53")
+			msg = "R53 IP or TTL is different. Updating R53"
 		case model.IPTriageDeleteR53:
-			log.Println("R53 DNS not found on VMW or VMW invalid IP. Delete R53")
+			msg = "R53 DNS not found on VMW or VMW invalid IP. Delete R53"
 		case model.IPTriageAddR53:
-			log.Println("VMC IP not found on R53. Add R53")
+			msg = "VMC IP not found on R53. Add R53"
+		}
+		if summary.Unowned {
+			msg = "Record exists and is not owned by this sync. Not adding"
+		}
+
+		keyvals := []interface{}{logging.FieldHostname, summary.HttpEntry, logging.FieldRecordType, summary.RecordType,
+			logging.FieldAction, model.IPTriageResultName(summary.Result), logging.FieldOldIP, summary.R53IP,
+			logging.FieldNewIP, summary.VmwIP, "old_ttl", summary.R53TTL, "new_ttl", summary.VmwTTL}
+
+		// records in sync make up most of a cycle and would drown out the changes
+		if summary.Result == model.IPTriageNoChange {
+			logger.Debug(msg, keyvals...)
+		} else {
+			logger.Info(msg, keyvals...)
 		}
 	}
+}
 
-	if isDryRun() {
-		log.Println("Configuration mentions dry run. No updates made to route 53")
-		return fmt.Errorf("DNS002: Dry run - no action taken")
+func updateDNS(ctx context.Context, logger *logging.Logger, triageResult map[string]model.IPTriageSummary,
+				changes []model.DNSChange, provider dns_api.DNSProvider, report *model.SyncReport) error {
+	if len(changes) == 0 {
+		logger.Info("No action encountered after processing. All records seem to be in sync. Exiting without action")
+		return nil
 	}
 
-	log.Println("Not a dry run. Commencing final sync to R53")
-	err := awsHelper.UpdateDNSRecords(triageResult, awsHelper)
+	batches, err := provider.ApplyChanges(ctx, logger, changes)
+	report.Batches = batches
+
+	// record the outcome against each entry so it can be reported back
+	for _, change := range changes {
+		summary := triageResult[change.Key]
+		summary.ChangeID = change.ChangeID
+		summary.SyncError = change.Error
+		summary.Propagation = change.Propagation
+		triageResult[change.Key] = summary
+
+		if change.Error != "" {
+			report.Failed[model.IPTriageResultName(change.Action)]++
+			logger.Error("Change failed", logging.FieldHostname, change.Name, logging.FieldRecordType, change.RecordType,
+				logging.FieldAction, model.IPTriageResultName(change.Action), logging.FieldOldIP, change.OldIP,
+				logging.FieldNewIP, change.IP, logging.FieldError, change.Error)
+		}
+	}
 
 	if err != nil {
-		log.Printf("We encountered an update error %v\n", err)
-		log.Println("We will not panic. The next cycle may be successful")
+		logger.Error("We encountered an update error. We will not panic. The next cycle may be successful",
+			logging.FieldError, err)
 	}
 
 	return err
 }
 
+func planChanges(logger *logging.Logger, triageResult map[string]model.IPTriageSummary) ([]model.DNSChange,
+	model.SyncReport) {
+	changes, skipped := dns_api.GetDNSChanges(logger, triageResult)
+
+	return changes, model.NewSyncReport(changes, skipped)
+}
+
+// SyncDNS - sends the triage result to the provider unless this is a dry run
+// or the delete guard refuses it. Having nothing to do and dry runs are not
+// errors, the report tells them apart
+func SyncDNS(ctx context.Context, logger *logging.Logger, triageResult map[string]model.IPTriageSummary,
+				provider dns_api.DNSProvider) (model.SyncReport, error) {
+	logger.Info("Starting final sync")
+	logTriage(logger, triageResult)
+	changes, report := planChanges(logger, triageResult)
+
+	if err := CheckDeleteGuard(logger, triageResult); err != nil {
+		logger.Error("Delete guard refused the sync", logging.FieldError, err)
+		report.Refused = true
+		return report, err
+	}
 
+	if IsDryRun() {
+		logger.Info("Configuration mentions dry run. No updates made", "provider", provider.Name())
+		report.DryRun = true
+		return report, nil
+	}
+
+	logger.Info("Not a dry run. Commencing final sync", "provider", provider.Name())
+	err := updateDNS(ctx, logger, triageResult, changes, provider, &report)
+	return report, err
+}
+
+// ApplyDNS - same as SyncDNS but ignores R53_UPDATE_DRY_RUN.
+// Used by the one-shot apply command, where the operator asked for the change
+func ApplyDNS(ctx context.Context, logger *logging.Logger, triageResult map[string]model.IPTriageSummary,
+				provider dns_api.DNSProvider) (model.SyncReport, error) {
+	logger.Info("Starting apply")
+	logTriage(logger, triageResult)
+	changes, report := planChanges(logger, triageResult)
+
+	if err := CheckDeleteGuard(logger, triageResult); err != nil {
+		logger.Error("Delete guard refused the apply", logging.FieldError, err)
+		report.Refused = true
+		return report, err
+	}
+
+	err := updateDNS(ctx, logger, triageResult, changes, provider, &report)
+	return report, err
+}
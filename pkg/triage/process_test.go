@@ -1,46 +1,94 @@
 package triage
 
 import (
+	"context"
 	"fmt"
-	"github.com/aws/aws-sdk-go/service/route53"
 	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
 	"vmc-dns-sync/pkg/dns_api"
+	"vmc-dns-sync/pkg/logging"
 	"vmc-dns-sync/pkg/model"
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
-var updateDNSRecordsMock func(triageInput map[string]model.IPTriageSummary,
-		awsHI dns_api.AwsHelperInterface) error
-var updateRoute53RecordSetsMock func(r53SyncSet route53.ChangeResourceRecordSetsInput) error
+const testTTL = 60
 
-type awsInterfaceTest struct {
+var applyChangesMock func(changes []model.DNSChange) error
+
+type providerTest struct {
+}
+
+func (p providerTest) Name() string {
+	return "test"
 }
 
-func(a awsInterfaceTest) UpdateDNSRecords(triageInput map[string]model.IPTriageSummary, awsHI dns_api.AwsHelperInterface) error {
-	return updateDNSRecordsMock(triageInput, awsHI)
+func (p providerTest) Zone() string {
+	return "ZTEST"
 }
 
-func (a awsInterfaceTest) UpdateRoute53RecordSets(r53SyncSet route53.ChangeResourceRecordSetsInput) error {
-	return updateRoute53RecordSetsMock(r53SyncSet)
+func (p providerTest) ListRecords(ctx context.Context, logger *logging.Logger) (map[string]model.DNSRecord, error) {
+	return map[string]model.DNSRecord{}, nil
+}
+
+func (p providerTest) ApplyChanges(ctx context.Context, logger *logging.Logger,
+	changes []model.DNSChange) (model.BatchCounts, error) {
+	// the test provider sends everything as one batch
+	err := applyChangesMock(changes)
+	if err != nil {
+		return model.BatchCounts{Attempted: 1}, err
+	}
+
+	return model.BatchCounts{Attempted: 1, Succeeded: 1}, nil
+}
+
+// primaryIPs - VMs that only report summary.guest.ipAddress
+func primaryIPs(vmcMap map[string]string) map[string]model.VMInfo {
+	vms := make(map[string]model.VMInfo)
+	for name, ip := range vmcMap {
+		vms[name] = model.VMInfo{Name: name, PrimaryIP: ip}
+	}
+	return vms
+}
+
+// mappingsOf - configmap style mappings without address selection overrides
+func mappingsOf(k8sMap map[string]string) map[string]model.DNSMapping {
+	mappings := make(map[string]model.DNSMapping)
+	for httpEntry, vmName := range k8sMap {
+		mappings[httpEntry] = model.DNSMapping{HttpEntry: httpEntry, VMNames: []string{vmName}}
+	}
+	return mappings
+}
+
+// recordsOf - provider records with the default TTL of testTTL
+func recordsOf(awsMap map[string]string) map[string]model.DNSRecord {
+	records := make(map[string]model.DNSRecord)
+	for key, ips := range awsMap {
+		records[key] = model.DNSRecord{IPs: ips, TTL: testTTL}
+	}
+	return records
 }
 
 func TestDefaultIsNotDryRun(t *testing.T) {
 	os.Setenv("R53_UPDATE_DRY_RUN", "")
-	assert.True(t, isDryRun())
+	assert.True(t, IsDryRun())
 	os.Setenv("R53_UPDATE_DRY_RUN", "some-invalid-value")
-	assert.True(t, isDryRun())
+	assert.True(t, IsDryRun())
 	os.Setenv("R53_UPDATE_DRY_RUN", "true")
-	assert.True(t, isDryRun())
+	assert.True(t, IsDryRun())
 	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
-	assert.False(t, isDryRun())
+	assert.False(t, IsDryRun())
 }
 
-func TestIPv6(t *testing.T) {
-	assert.False(t, isVMCv6("10.4.190.32"))
-	assert.False(t, isVMCv6("anything"))
-	assert.True(t, isVMCv6("fe80::3c00:2b77:5344:bb55"))
+func TestRecordTypes(t *testing.T) {
+	assert.Equal(t, model.RecordTypeA, getRecordType("10.4.190.32"))
+	assert.Equal(t, model.RecordTypeAAAA, getRecordType("2001:db8::32"))
+	assert.Equal(t, "", getRecordType("anything"))
+	assert.Equal(t, "", getRecordType("fe80::3c00:2b77:5344:bb55"))
+	assert.Equal(t, "", getRecordType("169.254.10.1"))
 }
 
 func Test_ThreePartMapping(t *testing.T) {
@@ -83,8 +131,8 @@ func Test_ThreePartMapping(t *testing.T) {
 	k8sMap["vmw-v6-ip"] = "builder-v6"
 	k8sMap["vmw-v6-ip-2"] = "builder-v6-2"
 
-	result := IPTriage(
-			vmcMap, awsMap, k8sMap,
+	result := IPTriage(logging.Discard(),
+			primaryIPs(vmcMap), recordsOf(awsMap), mappingsOf(k8sMap), model.AddressSelector{}, testTTL,
 		)
 
 	assert.Equal(t, result["missing-host-1"].R53IP, "")
@@ -156,43 +204,198 @@ func Test_ThreePartMapping(t *testing.T) {
 	assert.Equal(t, result["aws-only-3"].Result, model.IPTriageDeleteR53)
 
 	assert.Equal(t, result["vmw-v6-ip"].R53IP, "5.2.3.40")
-	assert.Equal(t, result["vmw-v6-ip"].VmwIP, "fe80::3c00:2b77:5344:bb55")
+	assert.Equal(t, result["vmw-v6-ip"].VmwIP, "")
 	assert.Equal(t, result["vmw-v6-ip"].Result, model.IPTriageDeleteR53)
 
-	assert.Equal(t, result["vmw-v6-ip-2"].R53IP, "")
-	assert.Equal(t, result["vmw-v6-ip-2"].VmwIP, "fe80::3d00:2b77:5344:bb55")
-	assert.Equal(t, result["vmw-v6-ip-2"].Result, model.IPTriageNoChange)
+	// link-local addresses are never published
+	_, ok := result["vmw-v6-ip-2"]
+	assert.False(t, ok)
+	_, ok = result[model.RecordKey("vmw-v6-ip-2", model.RecordTypeAAAA)]
+	assert.False(t, ok)
+}
+
+func TestDualStackTriage(t *testing.T) {
+	vmcMap := map[string]string{
+		"builder-v4":    "10.0.0.1",
+		"builder-v6":    "2001:db8::1",
+		"builder-moved": "2001:db8::2",
+	}
+	k8sMap := map[string]string{
+		"http://v4":    "builder-v4",
+		"http://v6":    "builder-v6",
+		"http://moved": "builder-moved",
+	}
+	awsMap := map[string]string{
+		"http://v4":          "10.0.0.1",
+		"http://v6#AAAA":     "2001:db8::9",
+		"http://moved":       "10.0.0.2",
+		"http://orphan#AAAA": "2001:db8::3",
+	}
+
+	result := IPTriage(logging.Discard(), primaryIPs(vmcMap), recordsOf(awsMap), mappingsOf(k8sMap), model.AddressSelector{}, testTTL)
+
+	assert.Equal(t, 5, len(result))
+	assert.Equal(t, model.IPTriageNoChange, result["http://v4"].Result)
+	assert.Equal(t, model.RecordTypeA, result["http://v4"].RecordType)
+
+	assert.Equal(t, model.IPTriageUpdateR53, result["http://v6#AAAA"].Result)
+	assert.Equal(t, "http://v6", result["http://v6#AAAA"].HttpEntry)
+	assert.Equal(t, model.RecordTypeAAAA, result["http://v6#AAAA"].RecordType)
+	assert.Equal(t, "2001:db8::1", result["http://v6#AAAA"].VmwIP)
+
+	// the VM went from IPv4 to IPv6: the A record goes, an AAAA record comes
+	assert.Equal(t, model.IPTriageDeleteR53, result["http://moved"].Result)
+	assert.Equal(t, model.IPTriageAddR53, result["http://moved#AAAA"].Result)
+
+	assert.Equal(t, model.IPTriageDeleteR53, result["http://orphan#AAAA"].Result)
+	assert.Equal(t, "http://orphan", result["http://orphan#AAAA"].HttpEntry)
 }
 
-func TestDetailedAWSFlow_DryRun(t *testing.T) {
-	var a awsInterfaceTest
+func TestPooledTriage(t *testing.T) {
+	vmcMap := map[string]string{
+		"pool-1": "10.0.0.2",
+		"pool-2": "10.0.0.1",
+		"pool-3": "2001:db8::3",
+		"grow-1": "10.0.1.1",
+		"grow-2": "10.0.1.2",
+	}
+	mappings := map[string]model.DNSMapping{
+		"http://pool": {HttpEntry: "http://pool", VMNames: []string{"pool-1", "pool-2", "pool-3", "pool-missing"}},
+		"http://grow": {HttpEntry: "http://grow", VMNames: []string{"grow-1", "grow-2"}},
+	}
+	awsMap := map[string]string{
+		"http://pool": "10.0.0.1,10.0.0.2",
+		"http://grow": "10.0.1.1",
+	}
+
+	result := IPTriage(logging.Discard(), primaryIPs(vmcMap), recordsOf(awsMap), mappings, model.AddressSelector{}, testTTL)
+
+	// the same set in another order is no change
+	assert.Equal(t, model.IPTriageNoChange, result["http://pool"].Result)
+	assert.Equal(t, "10.0.0.1,10.0.0.2", result["http://pool"].VmwIP)
+	assert.Equal(t, model.IPTriageAddR53, result["http://pool#AAAA"].Result)
+	assert.Equal(t, "2001:db8::3", result["http://pool#AAAA"].VmwIP)
+
+	assert.Equal(t, model.IPTriageUpdateR53, result["http://grow"].Result)
+	assert.Equal(t, "10.0.1.1,10.0.1.2", result["http://grow"].VmwIP)
+
+	assert.Equal(t, map[string]bool{"http://pool": true}, HostsForVMs(mappings, []string{"pool-3"}))
+}
+
+func TestTTLDrift(t *testing.T) {
+	vms := primaryIPs(map[string]string{"builder-1": "10.0.0.1", "builder-2": "10.0.0.2", "builder-3": "10.0.0.3"})
+	mappings := map[string]model.DNSMapping{
+		"http://default": {HttpEntry: "http://default", VMNames: []string{"builder-1"}},
+		"http://custom":  {HttpEntry: "http://custom", VMNames: []string{"builder-2"}, TTL: 300, Zone: "example.com"},
+		"http://new":     {HttpEntry: "http://new", VMNames: []string{"builder-3"}, TTL: 30},
+	}
+	records := map[string]model.DNSRecord{
+		"http://default": {IPs: "10.0.0.1", TTL: 60},
+		"http://custom":  {IPs: "10.0.0.2", TTL: 60},
+	}
+
+	result := IPTriage(logging.Discard(), vms, records, mappings, model.AddressSelector{}, testTTL)
+	assert.Equal(t, model.IPTriageNoChange, result["http://default"].Result)
+
+	// same IP, but the mapping asks for another TTL
+	assert.Equal(t, model.IPTriageUpdateR53, result["http://custom"].Result)
+	assert.Equal(t, int64(60), result["http://custom"].R53TTL)
+	assert.Equal(t, int64(300), result["http://custom"].VmwTTL)
+	assert.Equal(t, int64(30), result["http://new"].VmwTTL)
+	// the zone a mapping names goes along with its changes
+	assert.Equal(t, "example.com", result["http://custom"].Zone)
+
+	// a new default drifts every record that relies on it
+	result = IPTriage(logging.Discard(), vms, records, mappings, model.AddressSelector{}, 120)
+	assert.Equal(t, model.IPTriageUpdateR53, result["http://default"].Result)
+	assert.Equal(t, int64(120), result["http://default"].VmwTTL)
+}
+
+func TestUnownedRecordsLeftAlone(t *testing.T) {
+	var p providerTest
+	vms := primaryIPs(map[string]string{"builder-1": "10.0.0.1", "builder-2": "10.0.0.2"})
+	mappings := mappingsOf(map[string]string{"http://hand-made": "builder-1", "http://new": "builder-2"})
+	records := map[string]model.DNSRecord{
+		"http://hand-made": {IPs: "10.9.0.1", TTL: 300, Unowned: true},
+		"http://stray":     {IPs: "10.9.0.2", TTL: 300, Unowned: true},
+	}
+
+	result := IPTriage(logging.Discard(), vms, records, mappings, model.AddressSelector{}, testTTL)
+
+	// unowned records are never deleted, and a mapping to one does not take it over
+	assert.Equal(t, 2, len(result))
+	assert.True(t, result["http://hand-made"].Unowned)
+	assert.Equal(t, "10.9.0.1", result["http://hand-made"].R53IP)
+	assert.Equal(t, model.IPTriageAddR53, result["http://new"].Result)
+	assert.False(t, result["http://new"].Unowned)
+	assert.Equal(t, 1, len(BuildPlan(result, "ZTEST", time.Now()).Changes))
+
+	var sent []model.DNSChange
+	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
+	applyChangesMock = func(changes []model.DNSChange) error {
+		sent = changes
+		return nil
+	}
+
+	report, err := SyncDNS(context.Background(), logging.Discard(), result, p)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(sent))
+	assert.Equal(t, "new", sent[0].Name)
+	assert.Equal(t, []model.SkippedEntry{{Hostname: "http://hand-made", Action: "add",
+		Reason: "record exists and is not owned by this sync"}}, report.Skipped)
+	assert.Equal(t, "record exists and is not owned by this sync", result["http://hand-made"].SyncError)
+}
+
+func TestIPSets(t *testing.T) {
+	assert.Equal(t, "10.0.0.1,10.0.0.2", model.JoinIPs([]string{"10.0.0.2", "", "10.0.0.1", "10.0.0.2"}))
+	assert.Equal(t, "", model.JoinIPs(nil))
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2"}, model.SplitIPs("10.0.0.1,10.0.0.2"))
+	assert.Empty(t, model.SplitIPs(""))
+}
+
+func TestDetailedDNSFlow_DryRun(t *testing.T) {
+	var p providerTest
 	triageResult := make(map[string]model.IPTriageSummary)
 
 	os.Setenv("R53_UPDATE_DRY_RUN", "TRUE")
-	result := SyncRoute53(triageResult, a)
-	assert.True(t, strings.HasPrefix(result.Error(), "DNS002"))
+	applyChangesMock = func(changes []model.DNSChange) error {
+		t.Fatal("dry runs send nothing")
+		return nil
+	}
+	triageResult["sample-domain-1"] = model.IPTriageSummary{
+		HttpEntry: "http://sample-domain-1.example.com",
+		VmwIP:     "10.0.0.1",
+		Result:    model.IPTriageAddR53,
+	}
+
+	report, err := SyncDNS(context.Background(), logging.Discard(), triageResult, p)
+	assert.Nil(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, map[string]int{"add": 1}, report.Planned)
 }
 
-func TestDetailedAWSFlow_NonDryRun(t *testing.T) {
-	var a awsInterfaceTest
-	var ao dns_api.AWSDNSAPI
+func TestDetailedDNSFlow_NonDryRun(t *testing.T) {
+	var p providerTest
 	triageResult := make(map[string]model.IPTriageSummary)
 
 	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
-	updateDNSRecordsMock = ao.UpdateDNSRecords
-	updateRoute53RecordSetsMock = ao.UpdateRoute53RecordSets
-	result := SyncRoute53(triageResult, a)
-	assert.True(t, strings.HasPrefix(result.Error(), "DNS000"))
+	applyChangesMock = func(changes []model.DNSChange) error {
+		t.Fatal("nothing to send")
+		return nil
+	}
+	report, err := SyncDNS(context.Background(), logging.Discard(), triageResult, p)
+	assert.Nil(t, err)
+	assert.False(t, report.DryRun)
+	assert.Equal(t, 0, report.Total())
 }
 
-func TestDetailedAWSFlow_NoChange(t *testing.T) {
-	var a awsInterfaceTest
-	var ao dns_api.AWSDNSAPI
+func TestDetailedDNSFlow_NoChange(t *testing.T) {
+	var p providerTest
 	triageResult := make(map[string]model.IPTriageSummary)
 
 	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
-	updateDNSRecordsMock = ao.UpdateDNSRecords
-	updateRoute53RecordSetsMock = func(r53SyncSet route53.ChangeResourceRecordSetsInput) error {
+	applyChangesMock = func(changes []model.DNSChange) error {
+		t.Fatal("nothing to send")
 		return nil
 	}
 	triageResult["sample-domain-1"] = model.IPTriageSummary{
@@ -201,40 +404,66 @@ func TestDetailedAWSFlow_NoChange(t *testing.T) {
 	triageResult["sample-domain-2"] = model.IPTriageSummary{
 		Result: model.IPTriageNoChange,
 	}
-	result := SyncRoute53(triageResult, a)
-	assert.True(t, strings.HasPrefix(result.Error(), "DNS000"))
+	report, err := SyncDNS(context.Background(), logging.Discard(), triageResult, p)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, report.Total())
+	assert.Equal(t, model.BatchCounts{}, report.Batches)
 }
 
-func TestDetailedAWSFlow_NoError(t *testing.T) {
-	var a awsInterfaceTest
-	var ao dns_api.AWSDNSAPI
+func TestDetailedDNSFlow_NoError(t *testing.T) {
+	var p providerTest
+	var sent []model.DNSChange
 	triageResult := make(map[string]model.IPTriageSummary)
 
 	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
-	updateDNSRecordsMock = ao.UpdateDNSRecords
-	updateRoute53RecordSetsMock = func(r53SyncSet route53.ChangeResourceRecordSetsInput) error {
+	applyChangesMock = func(changes []model.DNSChange) error {
+		sent = changes
+		for i := range changes {
+			changes[i].ChangeID = "/change/C1"
+		}
 		return nil
 	}
 	triageResult["sample-domain-1"] = model.IPTriageSummary{
-		Result: model.IPTriageUpdateR53,
+		HttpEntry: "http://sample-domain-1.example.com",
+		VmwIP:     "10.0.0.1",
+		R53IP:     "10.0.0.9",
+		Result:    model.IPTriageUpdateR53,
 	}
 	triageResult["sample-domain-2"] = model.IPTriageSummary{
-		Result: model.IPTriageDeleteR53,
+		HttpEntry: "http://sample-domain-2.example.com",
+		R53IP:     "10.0.0.2",
+		Result:    model.IPTriageDeleteR53,
+	}
+	triageResult["sample-domain-3"] = model.IPTriageSummary{
+		HttpEntry: "http://" + strings.Repeat("x", 64) + ".example.com",
+		VmwIP:     "10.0.0.3",
+		Result:    model.IPTriageAddR53,
 	}
 
-	result := SyncRoute53(triageResult, a)
-	assert.True(t, result == nil)
+	report, err := SyncDNS(context.Background(), logging.Discard(), triageResult, p)
+	assert.True(t, err == nil)
+	assert.Equal(t, 2, len(sent))
+	assert.Equal(t, "/change/C1", triageResult["sample-domain-1"].ChangeID)
+	assert.Equal(t, "/change/C1", triageResult["sample-domain-2"].ChangeID)
+	assert.Equal(t, "hostname label exceeds 63 characters", triageResult["sample-domain-3"].SyncError)
+
+	assert.Equal(t, map[string]int{"update": 1, "delete": 1}, report.Planned)
+	assert.Equal(t, 0, report.TotalFailed())
+	assert.Equal(t, model.BatchCounts{Attempted: 1, Succeeded: 1}, report.Batches)
+	assert.Equal(t, []model.SkippedEntry{{Hostname: triageResult["sample-domain-3"].HttpEntry, Action: "add",
+		Reason: "hostname label exceeds 63 characters"}}, report.Skipped)
 }
 
-func TestDetailedAWSFlow_R53Error(t *testing.T) {
-	var a awsInterfaceTest
-	var ao dns_api.AWSDNSAPI
+func TestDetailedDNSFlow_ProviderError(t *testing.T) {
+	var p providerTest
 	triageResult := make(map[string]model.IPTriageSummary)
 
 	os.Setenv("R53_UPDATE_DRY_RUN", "FALSE")
-	updateDNSRecordsMock = ao.UpdateDNSRecords
-	updateRoute53RecordSetsMock = func(r53SyncSet route53.ChangeResourceRecordSetsInput) error {
-		return fmt.Errorf("ok, I raised an error")
+	applyChangesMock = func(changes []model.DNSChange) error {
+		for i := range changes {
+			changes[i].Error = "ok, I raised an error"
+		}
+		return model.NewBatchError(changes)
 	}
 	triageResult["sample-domain-1"] = model.IPTriageSummary{
 		Result: model.IPTriageUpdateR53,
@@ -243,6 +472,109 @@ func TestDetailedAWSFlow_R53Error(t *testing.T) {
 		Result: model.IPTriageDeleteR53,
 	}
 
-	result := SyncRoute53(triageResult, a)
-	assert.True(t, strings.HasPrefix(result.Error(), "DNS001"))
-}
\ No newline at end of file
+	report, err := SyncDNS(context.Background(), logging.Discard(), triageResult, p)
+	assert.Equal(t, &model.BatchError{Failed: 2, Total: 2}, err)
+	assert.Equal(t, "ok, I raised an error", triageResult["sample-domain-1"].SyncError)
+	assert.Equal(t, map[string]int{"update": 1, "delete": 1}, report.Failed)
+	assert.Equal(t, model.BatchCounts{Attempted: 1}, report.Batches)
+	assert.Equal(t, 0, report.Applied("update"))
+	assert.Equal(t, 0, report.Applied("delete"))
+}
+
+func TestTargetedTriage(t *testing.T) {
+	k8sMap := map[string]string{
+		"host-1": "builder-1",
+		"host-2": "builder-2",
+		"host-3": "builder-1",
+	}
+	triageResult := map[string]model.IPTriageSummary{
+		"host-1": {HttpEntry: "host-1", Result: model.IPTriageUpdateR53},
+		"host-2": {HttpEntry: "host-2", Result: model.IPTriageUpdateR53},
+		"host-3": {HttpEntry: "host-3", Result: model.IPTriageNoChange},
+		"host-4": {HttpEntry: "host-4", Result: model.IPTriageDeleteR53},
+	}
+
+	hosts := HostsForVMs(mappingsOf(k8sMap), []string{"builder-1", "builder-unknown"})
+	assert.Equal(t, map[string]bool{"host-1": true, "host-3": true}, hosts)
+
+	result := FilterTriage(triageResult, hosts)
+	assert.Equal(t, 2, len(result))
+	assert.Equal(t, model.IPTriageUpdateR53, result["host-1"].Result)
+	assert.Equal(t, model.IPTriageNoChange, result["host-3"].Result)
+}
+
+// pagedRoute53 - serves ListResourceRecordSets of one zone two record sets per page
+func pagedRoute53(recordSets []string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := 0
+		for i, recordSet := range recordSets {
+			if strings.Contains(recordSet, "<Name>"+r.URL.Query().Get("name")+"</Name><Type>"+
+				r.URL.Query().Get("type")+"</Type>") {
+				start = i
+				break
+			}
+		}
+
+		end := start + 2
+		truncated := end < len(recordSets)
+		if !truncated {
+			end = len(recordSets)
+		}
+
+		body := `<ListResourceRecordSetsResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/"><ResourceRecordSets>` +
+			strings.Join(recordSets[start:end], "") + `</ResourceRecordSets>` +
+			fmt.Sprintf("<IsTruncated>%t</IsTruncated><MaxItems>2</MaxItems>", truncated)
+		if truncated {
+			next := strings.SplitN(strings.SplitN(recordSets[end], "<Name>", 2)[1], "</Name><Type>", 2)
+			body += fmt.Sprintf("<NextRecordName>%s</NextRecordName><NextRecordType>%s</NextRecordType>",
+				next[0], strings.SplitN(next[1], "</Type>", 2)[0])
+		}
+		body += `</ListResourceRecordSetsResponse>`
+
+		w.Header().Set("Content-Type", "text/xml")
+		w.Write([]byte(body))
+	}
+}
+
+func TestLaterPagesAreNotReAdded(t *testing.T) {
+	recordSet := func(name, recordType string, ttl int, value string) string {
+		return fmt.Sprintf("<ResourceRecordSet><Name>%s</Name><Type>%s</Type><TTL>%d</TTL><ResourceRecords>"+
+			"<ResourceRecord><Value>%s</Value></ResourceRecord></ResourceRecords></ResourceRecordSet>",
+			name, recordType, ttl, value)
+	}
+
+	// NS and SOA fill the first page, every VM's record and ownership TXT come later
+	recordSets := []string{
+		recordSet("example.com.", "NS", 172800, "ns-1.awsdns-00.com."),
+		recordSet("example.com.", "SOA", 900, "ns-1.awsdns-00.com. hostmaster.example.com. 1 7200 900 1209600 86400"),
+	}
+	vms := make(map[string]string)
+	k8sMap := make(map[string]string)
+	for i := 0; i < 5; i++ {
+		name := fmt.Sprintf("host-%d.example.com", i)
+		recordSets = append(recordSets,
+			recordSet(name+".", "A", testTTL, fmt.Sprintf("10.0.0.%d", i)),
+			recordSet("_vmc-dns-sync."+name+".", "TXT", 300, "&quot;heritage=vmc-dns-sync,owner=vmc-dns-sync&quot;"))
+		vms[fmt.Sprintf("builder-%d", i)] = fmt.Sprintf("10.0.0.%d", i)
+		k8sMap["http://"+name] = fmt.Sprintf("builder-%d", i)
+	}
+
+	server := httptest.NewServer(pagedRoute53(recordSets))
+	defer server.Close()
+	for key, value := range map[string]string{"AWS_ACCESS_KEY_ID": "fake-key", "AWS_SECRET_ACCESS_KEY": "fake-secret",
+		"R53_ENDPOINT_URL": server.URL, "R53_HOSTED_ZONE_ID": "ZFAKE"} {
+		os.Setenv(key, value)
+		defer os.Unsetenv(key)
+	}
+
+	provider, err := dns_api.NewRoute53Provider(context.Background())
+	assert.Nil(t, err)
+	records, err := provider.ListRecords(context.Background(), logging.Discard())
+	assert.Nil(t, err)
+
+	result := IPTriage(logging.Discard(), primaryIPs(vms), records, mappingsOf(k8sMap), model.AddressSelector{}, testTTL)
+	assert.Equal(t, 5, len(result))
+	for key, summary := range result {
+		assert.Equal(t, model.IPTriageNoChange, summary.Result, key)
+	}
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+	"vmc-dns-sync/pkg/dns_api"
+	"vmc-dns-sync/pkg/logging"
+	"vmc-dns-sync/pkg/metrics"
+	"vmc-dns-sync/pkg/model"
+	"vmc-dns-sync/pkg/triage"
+)
+
+// watchers feeding the sync loop. Either may be nil when its watch mode is off.
+// vcenter is the session shared by the VM watch and the cycles
+type watchers struct {
+	vcenter    *dns_api.VCenterSession
+	vms        *dns_api.VMWatcher
+	configmaps *dns_api.ConfigMapWatcher
+	// running - watcher goroutines, waited for on shutdown
+	running *sync.WaitGroup
+}
+
+// statusWriteTimeout - longest the VmDnsRecord status write-back may take. It
+// does not use the cycle's context, so a cycle cut short still reports what it sent
+const statusWriteTimeout = 10 * time.Second
+
+// syncScope narrows a sync down to what a watch event touched.
+// A nil scope means a full sync
+type syncScope struct {
+	vmNames     []string
+	httpEntries []string
+}
+
+// triageInput - what a triage was built from, for scoping and status write-back
+type triageInput struct {
+	k8sDNSToVMWNameMap map[string]model.DNSMapping
+	vmDnsRecords       []model.DNSMapping
+}
+
+// newCycleLogger - logger tagging every line of one sync, plan or apply with a fresh cycle ID
+func newCycleLogger() *logging.Logger {
+	return logging.Default().With(logging.FieldCycle, logging.NewCycleID())
+}
+
+func (w watchers) getVMs(ctx context.Context, logger *logging.Logger) (map[string]model.VMInfo, error) {
+	// prefer the live watch cache once it has a full view of vCenter
+	if w.vms != nil && w.vms.Synced() {
+		logger.Info("Using VM watch cache")
+		return w.vms.GetVMs(), nil
+	}
+
+	return dns_api.GetVMs(ctx, logger, w.vcenter)
+}
+
+func (w watchers) getDNStoVMMapping(ctx context.Context, logger *logging.Logger) (map[string]model.DNSMapping, error) {
+	if w.configmaps != nil && w.configmaps.Synced() {
+		return w.configmaps.GetDNStoVMMapping(logger)
+	}
+
+	return dns_api.GetDNStoVMMapping(ctx, logger)
+}
+
+func countOwnedRecords(records map[string]model.DNSRecord) int {
+	count := 0
+	for _, record := range records {
+		if !record.Unowned {
+			count++
+		}
+	}
+
+	return count
+}
+
+func buildTriage(ctx context.Context, logger *logging.Logger, w watchers, provider dns_api.DNSProvider) (map[string]model.IPTriageSummary,
+	triageInput, error) {
+	var input triageInput
+	selector, err := dns_api.GetAddressSelector()
+
+	if err != nil {
+		logger.Error("Error reading the address selection", logging.FieldError, err)
+		return nil, input, err
+	}
+
+	// every source has to be read in full. A VM, record or mapping missing
+	// from one would turn into a delete
+	vmwNameToVMMap, err := w.getVMs(ctx, logger)
+
+	if err != nil {
+		logger.Error("Error fetching VMs", logging.FieldError, err)
+		return nil, input, &model.SourceError{Source: "vCenter VMs", Err: err}
+	}
+	awsDNSToR53IPMap, err := provider.ListRecords(ctx, logger)
+
+	if err != nil {
+		logger.Error("Error listing records", "provider", provider.Name(), logging.FieldError, err)
+		return nil, input, &model.SourceError{Source: provider.Name() + " records", Err: err}
+	}
+	k8sDNSToVMWNameMap, err := w.getDNStoVMMapping(ctx, logger)
+
+	if err != nil {
+		logger.Error("Error fetching configmaps", logging.FieldError, err)
+		return nil, input, &model.SourceError{Source: "configmaps", Err: err}
+	}
+
+	vmDnsRecords, err := dns_api.GetVmDnsRecordMappings(ctx, logger)
+	if err != nil {
+		logger.Error("Error fetching VmDnsRecords", logging.FieldError, err)
+		return nil, input, &model.SourceError{Source: "VmDnsRecords", Err: err}
+	}
+	k8sDNSToVMWNameMap = dns_api.MergeVmDnsRecords(logger, k8sDNSToVMWNameMap, vmDnsRecords)
+	metrics.ObserveSources(len(vmwNameToVMMap), len(k8sDNSToVMWNameMap), countOwnedRecords(awsDNSToR53IPMap))
+
+	input.k8sDNSToVMWNameMap = k8sDNSToVMWNameMap
+	input.vmDnsRecords = vmDnsRecords
+
+	return triage.IPTriage(logger, vmwNameToVMMap, awsDNSToR53IPMap, k8sDNSToVMWNameMap, selector,
+		dns_api.GetDefaultTTL()), input, nil
+}
+
+func syncOnce(ctx context.Context, logger *logging.Logger, w watchers, provider dns_api.DNSProvider,
+	scope *syncScope) (model.SyncReport, error) {
+	result, input, err := buildTriage(ctx, logger, w, provider)
+
+	if err != nil {
+		return model.SyncReport{}, err
+	}
+
+	if scope == nil {
+		metrics.ObserveTriage(result)
+	} else {
+		logger.Info("Targeted sync", logging.FieldVM, strings.Join(scope.vmNames, ","),
+			logging.FieldHostname, strings.Join(scope.httpEntries, ","))
+		hosts := triage.HostsForVMs(input.k8sDNSToVMWNameMap, scope.vmNames)
+		for _, httpEntry := range scope.httpEntries {
+			hosts[httpEntry] = true
+		}
+		result = triage.FilterTriage(result, hosts)
+	}
+
+	report, err := triage.SyncDNS(ctx, logger, result, provider)
+	updateStatus(logger, input, result, report)
+
+	return report, err
+}
+
+func logReport(logger *logging.Logger, report model.SyncReport, duration time.Duration) {
+	keyvals := []interface{}{"duration", duration, "planned", report.Total()}
+
+	switch {
+	case report.Total() == 0:
+		keyvals = append(keyvals, "outcome", "in sync")
+	case report.DryRun:
+		keyvals = append(keyvals, "outcome", "dry run")
+	default:
+		keyvals = append(keyvals, "outcome", "applied", "failed", report.TotalFailed(),
+			"batches_attempted", report.Batches.Attempted, "batches_succeeded", report.Batches.Succeeded)
+	}
+	for _, action := range []int{model.IPTriageAddR53, model.IPTriageUpdateR53, model.IPTriageDeleteR53} {
+		name := model.IPTriageResultName(action)
+		keyvals = append(keyvals, name, report.Planned[name])
+	}
+	keyvals = append(keyvals, "skipped", len(report.Skipped))
+
+	logger.Info("Cycle completed", keyvals...)
+	for _, skipped := range report.Skipped {
+		logger.Warn("Change skipped", logging.FieldHostname, skipped.Hostname, logging.FieldAction, skipped.Action,
+			"reason", skipped.Reason)
+	}
+}
+
+func updateStatus(logger *logging.Logger, input triageInput, result map[string]model.IPTriageSummary, report model.SyncReport) {
+	ctx, cancel := context.WithTimeout(context.Background(), statusWriteTimeout)
+	defer cancel()
+
+	dns_api.UpdateVmDnsRecordStatus(ctx, logger, input.vmDnsRecords, result, report)
+}